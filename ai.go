@@ -1,80 +1,204 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"net/http"
+	"os"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jmorganca/ollama/api"
 )
 
 type LLM interface {
-	bio(string)
-	summary(string) (string, error)
-	actionItems(string) ([]string, error)
+	// name identifies the backend and model, e.g. "ollama/zephyr".
+	name() string
+	// generate sends a system and user prompt to the model and returns its
+	// response. If delta isn't nil, it also receives every chunk of the
+	// response as soon as the model produces it.
+	generate(ctx context.Context, system, prompt string, delta func(string)) (string, error)
+	// contextSize is the number of tokens the model accepts, prompts and
+	// response together.
+	contextSize() int
+	// tokens estimates the number of tokens text takes up in a prompt.
+	tokens(text string) int
 }
 
+// openAIKeyFile can hold the OpenAI key instead of -token, so it can be
+// encrypted at rest (see rotate-key).
+const openAIKeyFile = "openai.key"
+
+// readOpenAIKey returns the key in openAIKeyFile, or token if there is no
+// such file.
+func readOpenAIKey(key *cipherKey, token string) (string, error) {
+	b, err := readSecretFile(key, openAIKeyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return token, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// newLLM creates the backend ("ollama" or "openai") for model. The number of
+// concurrent requests is limited to concurrency, or a default that suits the
+// backend when it's 0. contextSize overrides the context window of the model,
+// if it's set. $OPENAI_KEY takes precedence over token.
+func newLLM(backend, model, token string, concurrency, contextSize int) (LLM, error) {
+	var (
+		ai  LLM
+		err error
+	)
+	switch backend {
+	case "ollama":
+		ai, err = newOllama(model, contextSize)
+		if concurrency == 0 {
+			concurrency = 1
+		}
+	case "openai":
+		if key, ok := os.LookupEnv("OPENAI_KEY"); ok {
+			token = key
+		}
+		ai, err = newOpenAI(token, model, contextSize)
+		if concurrency == 0 {
+			concurrency = 4
+		}
+	default:
+		return nil, fmt.Errorf("unknown llm %q", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newLimitedLLM(ai, concurrency), nil
+}
+
+// limitedLLM caps the number of concurrent requests to a backend.
+type limitedLLM struct {
+	LLM
+	sem chan struct{}
+}
+
+func newLimitedLLM(ai LLM, n int) *limitedLLM {
+	if n < 1 {
+		n = 1
+	}
+	return &limitedLLM{
+		LLM: ai,
+		sem: make(chan struct{}, n),
+	}
+}
+
+func (l *limitedLLM) acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limitedLLM) release() {
+	<-l.sem
+}
+
+func (l *limitedLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	if err := l.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer l.release()
+	return l.LLM.generate(ctx, system, prompt, delta)
+}
+
+// ollamaDefaultContext is the context window ollama gives models unless
+// num_ctx is set.
+const ollamaDefaultContext = 2048
+
 type ollamaLLM struct {
-	model     string
-	biography string
-	c         *api.Client
+	model string
+	c     *api.Client
+	// numCtx is passed to ollama as num_ctx, if it's set.
+	numCtx int
 }
 
-func newOllama(model string) (*ollamaLLM, error) {
+func newOllama(model string, contextSize int) (*ollamaLLM, error) {
 	c, err := api.ClientFromEnvironment()
 	if err != nil {
 		return nil, err
 	}
 
 	return &ollamaLLM{
-		model: model,
-		c:     c,
+		model:  model,
+		c:      c,
+		numCtx: contextSize,
 	}, nil
 }
 
-var (
-	promptMessage = "Create a short summary in bullet points and any possible action items for me of the following email. Based on my given bio, propritize the action items accordingly by using either 'low', 'med' or 'high' qualifiers and identify the urgency and importance of the message. Always separate action items from the summary. The email conversation is : "
-	promptSystem  = "You are an assitant that summarizes email conversations. When interpreting the contex of the email content, use my bio to identify action item priorities. My bio is: "
-)
+func (ollama *ollamaLLM) name() string {
+	return "ollama/" + ollama.model
+}
+
+func (ollama *ollamaLLM) contextSize() int {
+	if ollama.numCtx > 0 {
+		return ollama.numCtx
+	}
+	return ollamaDefaultContext
+}
 
-func (ollama *ollamaLLM) bio(summary string) {
-	ollama.biography = summary
+// tokens errs on the high side, since ollama silently drops what doesn't fit
+// into the context. Llama style tokenizers need about a token for every three
+// characters of English, and more for other languages.
+func (ollama *ollamaLLM) tokens(text string) int {
+	return (utf8.RuneCountInString(text) + 2) / 3
 }
 
-func (ollama *ollamaLLM) summary(msg string) (string, error) {
+func (ollama *ollamaLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
 	a := ""
-	//prompt := "Create a really short summary in bullet points of the following email: " + msg
+	options := map[string]interface{}{}
+	if ollama.numCtx > 0 {
+		options["num_ctx"] = ollama.numCtx
+	}
 	rq := api.GenerateRequest{
-		Model:     "zephyr",
-		Prompt:    promptMessage + msg,
+		Model:     ollama.model,
+		Prompt:    prompt,
 		Template:  "",
-		System:    promptSystem + ollama.biography,
+		System:    system,
 		Context:   []int{},
 		Raw:       false,
 		Format:    "",
 		KeepAlive: &api.Duration{},
 		Images:    []api.ImageData{},
-		Options:   map[string]interface{}{},
+		Options:   options,
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), time.Duration(5*time.Minute))
-	if err := ollama.c.Generate(ctx, &rq, func(resp api.GenerateResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(5*time.Minute))
+	defer cancel()
+	start := time.Now()
+	err := ollama.c.Generate(ctx, &rq, func(resp api.GenerateResponse) error {
 		a += resp.Response
+		if delta != nil && resp.Response != "" {
+			delta(resp.Response)
+		}
+		if resp.Done {
+			reportUsage(ctx, "ollama", ollama.model, resp.PromptEvalCount, resp.EvalCount)
+		}
 		return nil
-	}); err != nil {
+	})
+	observeLLM("ollama", start, err)
+	if err != nil {
 		return "", err
 	}
 	return a, nil
 }
 
-func (ollama *ollamaLLM) actionItems(msg string) ([]string, error) {
-	return []string{}, nil
-}
-
 // Define structures to match the JSON response format
 type Message struct {
 	Role    string `json:"role"`
@@ -99,42 +223,106 @@ type Response struct {
 }
 
 type openAI struct {
-	biography string
-	token     string
+	model   string
+	token   string
+	context int
 }
 
-func newOpenAI(token string) (*openAI, error) {
-	return &openAI{token: token}, nil
+// openAIContextSizes are the context windows of OpenAI models, by model name
+// prefix. The first matching prefix wins.
+var openAIContextSizes = []struct {
+	prefix string
+	size   int
+}{
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4-1106", 128000},
+	{"gpt-4-0125", 128000},
+	{"gpt-4-32k", 32768},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo-instruct", 4096},
+	{"gpt-3.5-turbo", 16385},
 }
 
-func (openai *openAI) bio(summary string) {
-	openai.biography = summary
+// newOpenAI creates an OpenAI backend. The model defaults to gpt-3.5-turbo.
+// The context window is looked up by model, unless contextSize is set.
+func newOpenAI(token, model string, contextSize int) (*openAI, error) {
+	if model == "" {
+		model = "gpt-3.5-turbo"
+	}
+	if contextSize == 0 {
+		contextSize = 8192
+		for _, c := range openAIContextSizes {
+			if strings.HasPrefix(model, c.prefix) {
+				contextSize = c.size
+				break
+			}
+		}
+	}
+	return &openAI{model: model, token: token, context: contextSize}, nil
+}
+
+func (openai *openAI) name() string {
+	return "openai/" + openai.model
+}
+
+func (openai *openAI) contextSize() int {
+	return openai.context
+}
+
+// tokens assumes about four characters per token, which holds for English
+// text with OpenAI's tokenizers.
+func (openai *openAI) tokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
 }
 
-func (openai *openAI) summary(msg string) (string, error) {
+// request builds a chat completion request.
+func (openai *openAI) request(ctx context.Context, system, prompt string, stream bool) (*http.Request, error) {
 	apiURL := "https://api.openai.com/v1/chat/completions"
 
 	payload := map[string]interface{}{
-		"model": "gpt-3.5-turbo",
+		"model": openai.model,
 		"messages": []map[string]string{
-			{"role": "system", "content": promptSystem + openai.biography},
-			{"role": "user", "content": promptMessage + msg},
+			{"role": "system", "content": system},
+			{"role": "user", "content": prompt},
 		},
 		"temperature": 0.7,
+		"stream":      stream,
+	}
+	if stream {
+		payload["stream_options"] = map[string]interface{}{"include_usage": true}
 	}
 
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		log.Fatalf("Error marshalling payload: %v", err)
+		return nil, fmt.Errorf("error marshalling payload: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(payloadBytes))
 	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+openai.token)
+	return req, nil
+}
+
+func (openai *openAI) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	if delta != nil {
+		return openai.stream(ctx, system, prompt, delta)
+	}
+	return openai.complete(ctx, system, prompt)
+}
+
+func (openai *openAI) complete(ctx context.Context, system, prompt string) (a string, err error) {
+	start := time.Now()
+	defer func() { observeLLM("openai", start, err) }()
+
+	req, err := openai.request(ctx, system, prompt, false)
+	if err != nil {
+		return "", err
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -153,6 +341,7 @@ func (openai *openAI) summary(msg string) (string, error) {
 	if err := json.Unmarshal(body, &response); err != nil {
 		return "", err
 	}
+	reportUsage(ctx, "openai", openai.model, response.Usage["prompt_tokens"], response.Usage["completion_tokens"])
 
 	if len(response.Choices) > 0 && response.Choices[0].Message.Content != "" {
 		responseContent = response.Choices[0].Message.Content
@@ -161,6 +350,72 @@ func (openai *openAI) summary(msg string) (string, error) {
 	return responseContent, nil
 }
 
-func (openai *openAI) actionItems(msg string) ([]string, error) {
-	return []string{}, nil
+// StreamChunk is a single server-sent event of a streamed chat completion.
+type StreamChunk struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index        int     `json:"index"`
+		Delta        Message `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	// Usage is only set on the last chunk.
+	Usage map[string]int `json:"usage"`
+}
+
+// stream requests the completion as server-sent events and passes the
+// content of each event to delta.
+func (openai *openAI) stream(ctx context.Context, system, prompt string, delta func(string)) (a string, err error) {
+	start := time.Now()
+	defer func() { observeLLM("openai", start, err) }()
+
+	req, err := openai.request(ctx, system, prompt, true)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("openai: %s: %s", resp.Status, body)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+		var chunk StreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", err
+		}
+		if chunk.Usage != nil {
+			reportUsage(ctx, "openai", openai.model, chunk.Usage["prompt_tokens"], chunk.Usage["completion_tokens"])
+		}
+		for _, c := range chunk.Choices {
+			if c.Delta.Content == "" {
+				continue
+			}
+			a += c.Delta.Content
+			delta(c.Delta.Content)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return a, nil
 }
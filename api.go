@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// apiError is an error with the HTTP status it should be reported with.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return &apiError{status: http.StatusBadRequest, err: err}
+}
+
+// apiFunc handles a JSON API request and returns the value to respond with.
+type apiFunc func(r *http.Request) (interface{}, error)
+
+// handleAPI registers a JSON API endpoint.
+//
+// Requests other than GET must carry the X-Requested-With header. Browsers
+// only send custom headers to other origins after a CORS preflight, which
+// this server never allows, so other websites can't trigger actions through
+// the user's browser.
+func (web *webAPI) handleAPI(pattern string, h apiFunc) {
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Header.Get("X-Requested-With") != "mailassist" {
+			http.Error(w, "missing X-Requested-With header", http.StatusForbidden)
+			return
+		}
+		v, err := h(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var apiErr *apiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.status
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				status = http.StatusNotFound
+			}
+			if status == http.StatusInternalServerError {
+				log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	})
+}
+
+// decodeRequest decodes the JSON body of a POST request into v.
+func decodeRequest(r *http.Request, v interface{}) error {
+	if r.Method != http.MethodPost {
+		return &apiError{status: http.StatusMethodNotAllowed, err: errors.New("method not allowed")}
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest(err)
+	}
+	return nil
+}
+
+type webNewsletter struct {
+	ID           uint
+	Date         time.Time
+	From         string
+	Subject      string
+	OneClick     bool
+	Unsubscribed bool
+}
+
+// handleNewsletters serves the newsletter digest and one-click unsubscribe.
+func (web *webAPI) handleNewsletters(store *sqliteDB) {
+	web.handleAPI("/api/newsletters", func(r *http.Request) (interface{}, error) {
+		msgs, err := store.getNewsletters(time.Now().AddDate(0, 0, -7))
+		if err != nil {
+			return nil, err
+		}
+		newsletters := []webNewsletter{}
+		for _, m := range msgs {
+			newsletters = append(newsletters, webNewsletter{
+				ID:           m.ID,
+				Date:         m.Date,
+				From:         m.From,
+				Subject:      m.Subject,
+				OneClick:     m.OneClick,
+				Unsubscribed: m.Unsubscribed,
+			})
+		}
+		return newsletters, nil
+	})
+
+	web.handleAPI("/api/unsubscribe", func(r *http.Request) (interface{}, error) {
+		var req struct{ ID uint }
+		if err := decodeRequest(r, &req); err != nil {
+			return nil, err
+		}
+		if req.ID == 0 {
+			return nil, badRequest(errors.New("missing message ID"))
+		}
+		m, err := store.getMessage(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !m.Bulk || !m.OneClick {
+			return nil, badRequest(errors.New("message doesn't support one-click unsubscribe"))
+		}
+		if err := unsubscribe(r.Context(), m.Unsubscribe); err != nil {
+			return nil, err
+		}
+		return nil, store.markUnsubscribed(m)
+	})
+}
+
+// Limits of the summaries returned by /api/messages.
+const (
+	defaultMessagesLimit = 50
+	maxMessagesLimit     = 200
+)
+
+// handleMessages serves the summaries of the last week. min_score leaves out
+// messages with a lower priority score, and sort=score sorts them by score
+// instead of by date.
+func (web *webAPI) handleMessages(store *sqliteDB) {
+	web.handleAPI("/api/messages", func(r *http.Request) (interface{}, error) {
+		q := r.URL.Query()
+		minScore, limit := 0, defaultMessagesLimit
+		var err error
+		if s := q.Get("min_score"); s != "" {
+			if minScore, err = strconv.Atoi(s); err != nil {
+				return nil, badRequest(fmt.Errorf("invalid min_score: %v", err))
+			}
+		}
+		if s := q.Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+				return nil, badRequest(fmt.Errorf("invalid limit %q", s))
+			}
+			limit = min(limit, maxMessagesLimit)
+		}
+		byScore := false
+		switch q.Get("sort") {
+		case "", "date":
+		case "score":
+			byScore = true
+		default:
+			return nil, badRequest(fmt.Errorf("unknown sort %q", q.Get("sort")))
+		}
+
+		msgs, err := store.getSummaries(time.Now().AddDate(0, 0, -7), minScore, byScore, limit)
+		if err != nil {
+			return nil, err
+		}
+		summaries := []webMsg{}
+		for i := range msgs {
+			summaries = append(summaries, storedMsg(&msgs[i]))
+		}
+		return summaries, nil
+	})
+}
+
+type webReplyRequest struct {
+	// ID is the Message-ID or provider ID the message was pushed with.
+	ID          string
+	Instruction string
+	Body        string
+}
+
+// handleReplies serves reply drafting. /api/reply asks the LLM for a reply,
+// which the user can edit before /api/draft saves it with the provider.
+func (web *webAPI) handleReplies(mbox *mailBox, store *sqliteDB, drafts draftSaver) {
+	message := func(r *http.Request) (*sqlMessage, *webReplyRequest, error) {
+		var req webReplyRequest
+		if err := decodeRequest(r, &req); err != nil {
+			return nil, nil, err
+		}
+		if req.ID == "" {
+			return nil, nil, badRequest(errors.New("missing message ID"))
+		}
+		m, err := store.findMessage(req.ID)
+		return m, &req, err
+	}
+
+	web.handleAPI("/api/reply", func(r *http.Request) (interface{}, error) {
+		m, req, err := message(r)
+		if err != nil {
+			return nil, err
+		}
+		body, err := draftReply(r.Context(), mbox, store, m, req.Instruction)
+		if err != nil {
+			return nil, err
+		}
+		return struct{ Body string }{body}, nil
+	})
+
+	web.handleAPI("/api/draft", func(r *http.Request) (interface{}, error) {
+		m, req, err := message(r)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(req.Body) == "" {
+			return nil, badRequest(errors.New("empty reply"))
+		}
+		if drafts == nil {
+			return nil, &apiError{status: http.StatusNotImplemented, err: errors.New("the mail provider can't save drafts")}
+		}
+		id, err := drafts.saveDraft(r.Context(), newReplyDraft(m, req.Body))
+		if err != nil {
+			return nil, err
+		}
+		return struct{ DraftID string }{id}, nil
+	})
+}
+
+// handleActions applies actions, like archiving, to messages in the mailbox
+// of the provider.
+func (web *webAPI) handleActions(store *sqliteDB, modifier mailModifier) {
+	web.handleAPI("/api/action", func(r *http.Request) (interface{}, error) {
+		var req struct {
+			// ID is the Message-ID or provider ID the message was pushed
+			// with.
+			ID     string
+			Action string
+			Label  string
+		}
+		if err := decodeRequest(r, &req); err != nil {
+			return nil, err
+		}
+		switch req.Action {
+		case actionRead, actionUnread, actionArchive, actionStar, actionUnstar:
+		case actionLabel, actionUnlabel:
+			if strings.TrimSpace(req.Label) == "" {
+				return nil, badRequest(errors.New("missing label"))
+			}
+		default:
+			return nil, badRequest(fmt.Errorf("unknown action %q", req.Action))
+		}
+		if modifier == nil {
+			return nil, &apiError{status: http.StatusNotImplemented, err: errors.New("the mail provider can't modify messages")}
+		}
+		m, err := store.findMessage(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		if m.ProviderID == "" {
+			return nil, badRequest(errors.New("message has no provider ID"))
+		}
+		return nil, modifier.modify(r.Context(), m.ProviderID, req.Action, strings.TrimSpace(req.Label))
+	})
+}
+
+// handleFeedback stores the feedback of the user on summaries: ratings,
+// priority corrections and missed action items.
+func (web *webAPI) handleFeedback(mbox *mailBox, store *sqliteDB) {
+	web.handleAPI("/api/feedback", func(r *http.Request) (interface{}, error) {
+		var req struct {
+			// ID is the Message-ID or provider ID the message was pushed
+			// with.
+			ID         string
+			Kind       string
+			Priority   string
+			ActionItem string
+		}
+		if err := decodeRequest(r, &req); err != nil {
+			return nil, err
+		}
+		switch req.Kind {
+		case feedbackUp, feedbackDown:
+		case feedbackPriority:
+			if priorityRank(req.Priority) == priorityRank("") {
+				return nil, badRequest(fmt.Errorf("unknown priority %q", req.Priority))
+			}
+		case feedbackMissedAction:
+			if strings.TrimSpace(req.ActionItem) == "" {
+				return nil, badRequest(errors.New("missing action item"))
+			}
+		default:
+			return nil, badRequest(fmt.Errorf("unknown feedback %q", req.Kind))
+		}
+		m, err := store.findMessage(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		f := newFeedback(mbox.name, m, req.Kind)
+		switch req.Kind {
+		case feedbackPriority:
+			f.Priority, f.Was = req.Priority, m.Priority
+		case feedbackMissedAction:
+			f.ActionItem = strings.TrimSpace(req.ActionItem)
+		}
+		if err := store.addFeedback(f); err != nil {
+			return nil, err
+		}
+		feedbackReceived.WithLabelValues(req.Kind).Inc()
+		return nil, nil
+	})
+}
+
+// handleAuth lets the user authorize mailassist again from the web UI, when
+// the authorization with the provider was revoked.
+//
+// Google only redirects desktop apps back to loopback addresses, so the UI
+// has to be opened on localhost or 127.0.0.1.
+func (web *webAPI) handleAuth(auth *tokenStore) {
+	web.handleAPI("/api/auth", func(r *http.Request) (interface{}, error) {
+		return struct{ Required bool }{auth.authRequired()}, nil
+	})
+	http.HandleFunc("/auth/start", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			http.Error(w, "open mailassist on localhost to authorize it", http.StatusBadRequest)
+			return
+		}
+		u, err := auth.authURL("http://" + r.Host + "/auth/callback")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+	})
+	http.HandleFunc("/auth/callback", func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.completeAuth(r.Context(), r.URL); err != nil {
+			log.Printf("Could not authorize: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
+
+var digestPage = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+.priority-low, .priority-med, .priority-high { font-weight: bold; background: black; }
+.priority-low { color: #99ce88; }
+.priority-med { color: #49a8fc; }
+.priority-high { color: #fc6764; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Body}}<p><small>{{.Messages}} messages since {{.From}}</small></p>
+{{.Body}}{{else}}<p>There is no digest yet.</p>{{end}}
+<p><button id="generate">Generate a new digest</button></p>
+<script>
+// Generating costs LLM requests, so it's a POST to the JSON API, which
+// requires the X-Requested-With header.
+document.getElementById('generate').addEventListener('click', function() {
+	this.disabled = true;
+	fetch('/api/digest', {
+		method: 'POST',
+		headers: {'Content-Type': 'application/json', 'X-Requested-With': 'mailassist'},
+		body: JSON.stringify({Period: {{.Period}}}),
+	}).then(function(r) {
+		if (r.ok) {
+			location.reload();
+		} else {
+			r.text().then(function(t) { alert('Could not generate the digest: ' + t); });
+		}
+	});
+});
+</script>
+</body>
+</html>
+`))
+
+// handleDigest serves the latest digest of a period, as HTML or, with
+// format=markdown, as markdown. GET requests never generate a digest, since
+// that costs LLM requests; POST /api/digest does.
+func (web *webAPI) handleDigest(dg *digester) {
+	http.HandleFunc("/digest", func(w http.ResponseWriter, r *http.Request) {
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = digestDaily
+		}
+		if _, _, err := digestRange(period, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d := dg.last(period)
+
+		if r.URL.Query().Get("format") == "markdown" {
+			if d == nil {
+				http.Error(w, "no "+period+" digest yet", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+			fmt.Fprintf(w, "# %s\n\n%s\n", d.title(), d.markdown)
+			return
+		}
+		page := map[string]interface{}{
+			"Title":  strings.ToUpper(period[:1]) + period[1:] + " digest",
+			"Period": period,
+		}
+		if d != nil {
+			page["Title"] = d.title()
+			page["Messages"] = d.messages
+			page["From"] = d.from.Format("Mon 2 Jan 15:04")
+			// The body is sanitized by d.html.
+			page["Body"] = template.HTML(d.html())
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := digestPage.Execute(w, page); err != nil {
+			log.Printf("Error rendering digest: %v", err)
+		}
+	})
+
+	web.handleAPI("/api/digest", func(r *http.Request) (interface{}, error) {
+		var req struct{ Period string }
+		if err := decodeRequest(r, &req); err != nil {
+			return nil, err
+		}
+		if _, _, err := digestRange(req.Period, time.Now()); err != nil {
+			return nil, badRequest(err)
+		}
+		d, err := dg.generate(r.Context(), req.Period)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Title    string
+			Messages int
+		}{d.title(), d.messages}, nil
+	})
+}
+
+var usagePage = template.Must(template.New("usage").Funcs(template.FuncMap{
+	"cost": func(c float64) string { return fmt.Sprintf("$%.2f", c) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>LLM usage</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.over { color: #fc6764; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>LLM usage</h1>
+<p>This month: {{cost .Month}}{{if .Budget}} of the {{cost .Budget.Monthly}} budget
+{{- if ge .Month .Budget.Monthly}} <span class="over">(spent, {{if .Budget.Fallback}}using {{.Budget.Fallback}}{{else}}summarizing is paused{{end}})</span>{{end}}{{end}}</p>
+{{range .Tables}}
+<h2>{{.Title}}</h2>
+<table>
+<tr><th>{{.Period}}</th><th>Requests</th><th>Prompt tokens</th><th>Completion tokens</th><th>Cost</th></tr>
+{{range .Totals}}<tr><td>{{.Period}}</td><td>{{.Requests}}</td><td>{{.PromptTokens}}</td><td>{{.CompletionTokens}}</td><td>{{cost .Cost}}</td></tr>
+{{else}}<tr><td colspan="5">No requests yet.</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// handleUsage serves the token usage and cost of the LLM requests, per day of
+// the current month and per month of the last year.
+func (web *webAPI) handleUsage(usage *usageTracker) {
+	http.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		month, err := usage.monthCost(now)
+		if err != nil {
+			log.Printf("GET /usage: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		days, err := usage.totals(monthStart(now), "2006-01-02")
+		if err != nil {
+			log.Printf("GET /usage: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		months, err := usage.totals(monthStart(now).AddDate(0, -11, 0), "2006-01")
+		if err != nil {
+			log.Printf("GET /usage: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := usagePage.Execute(w, map[string]interface{}{
+			"Month":  month,
+			"Budget": usage.budget,
+			"Tables": []map[string]interface{}{
+				{"Title": "This month", "Period": "Day", "Totals": days},
+				{"Title": "Last 12 months", "Period": "Month", "Totals": months},
+			},
+		}); err != nil {
+			log.Printf("Error rendering usage: %v", err)
+		}
+	})
+}
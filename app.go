@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// alertTimeout limits how long mailing an alert may take.
+const alertTimeout = 30 * time.Second
+
+// app connects the pipeline of a mailbox to the store, the web UI and the
+// notifications.
+type app struct {
+	mbox     *mailBox
+	store    *sqliteDB
+	web      *webAPI
+	notifier notifier
+	// mailer mails the summaries of high priority messages, if it's set.
+	mailer *smtpSender
+	// usage pauses the cycles while the budget is spent, if it's set.
+	usage   *usageTracker
+	workers int
+}
+
+// runOnce processes one polling cycle.
+func (a *app) runOnce(ctx context.Context) error {
+	if a.usage != nil && a.usage.paused(time.Now()) {
+		log.Println("The monthly llm budget is spent, summarizing is paused")
+		return nil
+	}
+	// Alerts are mailed in the background, so a slow SMTP server doesn't
+	// hold up the pipeline, but the cycle only ends once they're sent.
+	var alerts sync.WaitGroup
+	defer alerts.Wait()
+	return newPipeline(a.mbox, a.workers, a.hooks(ctx, &alerts)).run(ctx)
+}
+
+// hooks connect the pipeline stages to the rest of the app. Alerts are sent
+// with ctx and added to alerts.
+func (a *app) hooks(ctx context.Context, alerts *sync.WaitGroup) pipelineHooks {
+	return pipelineHooks{
+		skip: func(m *mailMessage) bool {
+			if a.store.wasRead(m) {
+				messagesSkipped.WithLabelValues("dedupe").Inc()
+				return true
+			}
+			return false
+		},
+		started: func(m *mailMessage) {
+			a.web.pushStarted(m)
+		},
+		delta: func(m *mailMessage, text string) {
+			a.web.pushDelta(m.id(), text)
+		},
+		failed: func(m *mailMessage, err error) {
+			a.web.pushFailed(m.id(), err)
+		},
+		store: func(m *mailMessage, summary string) error {
+			return a.store.saveMessage(m, summary)
+		},
+		notify: func(m *mailMessage, summary string) {
+			if !m.actions.Silent && a.mbox.scorer.notifies(m.priority) {
+				a.notifier.notify(m.conversation.subject)
+			}
+			a.web.push(m, highlightPriority(markdownMessage(summary)), markdownMessage(m.msg))
+			if a.mailer != nil && a.mailer.cfg.Alerts && m.priority.Level == "high" {
+				subject := m.conversation.subject
+				alerts.Add(1)
+				go func() {
+					defer alerts.Done()
+					ctx, cancel := context.WithTimeout(ctx, alertTimeout)
+					defer cancel()
+					if err := a.mailer.send(ctx, "[high] "+subject, summary,
+						sanitizeHTML(highlightPriority(markdownMessage(summary)))); err != nil {
+						log.Printf("Could not mail alert for %q: %v", subject, err)
+					}
+				}()
+			}
+		},
+		newsletters: func(msgs []*mailMessage) {
+			a.web.pushNewsletters()
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//go:embed html
+var embeddedAssets embed.FS
+
+// assetHandler serves the web UI with cache validation headers. Embedded
+// assets get a content hash as ETag, so browsers revalidate cheaply and pick
+// up a new UI as soon as the binary changes.
+type assetHandler struct {
+	files http.Handler
+	etags map[string]string
+	dev   bool
+}
+
+// newAssetHandler serves the embedded UI, or the files in dir when it's set,
+// which is useful while working on the UI.
+func newAssetHandler(dir string) (*assetHandler, error) {
+	if dir != "" {
+		return &assetHandler{
+			files: http.FileServer(http.Dir(dir)),
+			dev:   true,
+		}, nil
+	}
+
+	sub, err := fs.Sub(embeddedAssets, "html")
+	if err != nil {
+		return nil, err
+	}
+	etags := make(map[string]string)
+	err = fs.WalkDir(sub, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(sub, p)
+		if err != nil {
+			return err
+		}
+		etags["/"+p] = fmt.Sprintf(`"%x"`, sha256.Sum256(b))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to index embedded assets: %v", err)
+	}
+	return &assetHandler{
+		files: http.FileServer(http.FS(sub)),
+		etags: etags,
+	}, nil
+}
+
+func (h *assetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.dev {
+		w.Header().Set("Cache-Control", "no-cache")
+		h.files.ServeHTTP(w, r)
+		return
+	}
+
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(p, "/") {
+		p += "index.html"
+	}
+	// http.FileServer answers If-None-Match with 304 when the ETag header
+	// is already set.
+	if etag, ok := h.etags[p]; ok {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	h.files.ServeHTTP(w, r)
+}
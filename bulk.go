@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// bulkInfo describes a message that was sent in bulk, like a newsletter or
+// marketing mail.
+type bulkInfo struct {
+	// reason is the header that gave the message away.
+	reason string
+	// unsubscribe is the HTTPS URL from List-Unsubscribe, if any, and
+	// oneClick reports whether it supports RFC 8058 one-click unsubscribe.
+	unsubscribe string
+	oneClick    bool
+}
+
+// espHeaders are headers added by email service providers that are mostly
+// used for bulk mail.
+var espHeaders = []string{
+	"X-Mailgun-Sid",
+	"X-Sg-Eid",
+	"X-Ses-Outgoing",
+	"X-Mc-User",
+	"X-Mandrill-User",
+	"X-Campaign",
+	"X-Campaignid",
+	"X-Mailchimp-Campaign",
+	"X-Sfmc-Stack",
+	"X-Hs-Cid",
+	"X-Csa-Complaints",
+}
+
+// espDomains are Return-Path domains of email service providers.
+var espDomains = []string{
+	"mcsv.net",
+	"rsgsv.net",
+	"mcdlv.net",
+	"sendgrid.net",
+	"amazonses.com",
+	"mailgun.org",
+	"sparkpostmail.com",
+	"mktomail.com",
+	"exacttarget.com",
+	"hubspotemail.net",
+	"cmail19.com",
+	"cmail20.com",
+}
+
+// detectBulk returns the bulk mail details of a message, or nil if it
+// looks like it was sent to the user personally. header is keyed by
+// canonical header names.
+func detectBulk(header map[string]string) *bulkInfo {
+	reason := ""
+	switch {
+	case header["List-Unsubscribe"] != "":
+		reason = "List-Unsubscribe"
+	case header["List-Id"] != "":
+		reason = "List-Id"
+	}
+	switch strings.ToLower(strings.TrimSpace(header["Precedence"])) {
+	case "bulk", "list", "junk":
+		reason = "Precedence"
+	}
+	if a := strings.ToLower(strings.TrimSpace(header["Auto-Submitted"])); a != "" && a != "no" {
+		reason = "Auto-Submitted"
+	}
+	if reason == "" {
+		for _, h := range espHeaders {
+			if header[h] != "" {
+				reason = h
+				break
+			}
+		}
+	}
+	if reason == "" {
+		returnPath := strings.ToLower(strings.Trim(header["Return-Path"], "<> "))
+		for _, d := range espDomains {
+			if strings.HasSuffix(returnPath, "."+d) || strings.HasSuffix(returnPath, "@"+d) {
+				reason = "Return-Path"
+				break
+			}
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+
+	b := &bulkInfo{reason: reason}
+	b.unsubscribe, b.oneClick = unsubscribeURL(header)
+	return b
+}
+
+// unsubscribeURL returns the HTTPS unsubscribe URL of a message and whether
+// it supports one-click unsubscribe (RFC 8058).
+func unsubscribeURL(header map[string]string) (string, bool) {
+	for _, part := range strings.Split(header["List-Unsubscribe"], ",") {
+		part = strings.Trim(strings.TrimSpace(part), "<>")
+		u, err := url.Parse(part)
+		if err != nil || u.Scheme != "https" {
+			continue
+		}
+		oneClick := strings.EqualFold(strings.TrimSpace(header["List-Unsubscribe-Post"]), "List-Unsubscribe=One-Click")
+		return u.String(), oneClick
+	}
+	return "", false
+}
+
+// unsubscribe performs an RFC 8058 one-click unsubscribe.
+func unsubscribe(ctx context.Context, link string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", link, strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{
+		// The RFC asks senders not to redirect, and following one could
+		// end up in a page that needs user interaction anyway.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unsubscribe failed: %s", resp.Status)
+	}
+	return nil
+}
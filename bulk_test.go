@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestDetectBulk(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      map[string]string
+		reason      string
+		unsubscribe string
+		oneClick    bool
+	}{
+		{"personal", map[string]string{"From": "ann@example.com"}, "", "", false},
+		{"one-click", map[string]string{
+			"List-Unsubscribe":      "<mailto:unsub@news.example.com>, <https://news.example.com/u/123>",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}, "List-Unsubscribe", "https://news.example.com/u/123", true},
+		{"http only", map[string]string{"List-Unsubscribe": "<http://news.example.com/u/123>"}, "List-Unsubscribe", "", false},
+		{"list id", map[string]string{"List-Id": "<dev.lists.example.com>"}, "List-Id", "", false},
+		{"precedence", map[string]string{"Precedence": "Bulk"}, "Precedence", "", false},
+		{"auto-submitted", map[string]string{"Auto-Submitted": "auto-generated"}, "Auto-Submitted", "", false},
+		{"not auto-submitted", map[string]string{"Auto-Submitted": "no"}, "", "", false},
+		{"esp header", map[string]string{"X-Sg-Eid": "abc"}, "X-Sg-Eid", "", false},
+		{"esp return path", map[string]string{"Return-Path": "<bounce-123@mail123.mcsv.net>"}, "Return-Path", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := detectBulk(tt.header)
+			if tt.reason == "" {
+				if b != nil {
+					t.Fatalf("detectBulk() = %+v, want nil", b)
+				}
+				return
+			}
+			if b == nil {
+				t.Fatal("detectBulk() = nil")
+			}
+			if b.reason != tt.reason || b.unsubscribe != tt.unsubscribe || b.oneClick != tt.oneClick {
+				t.Errorf("detectBulk() = %+v, want reason %q, unsubscribe %q, one-click %v", b, tt.reason, tt.unsubscribe, tt.oneClick)
+			}
+		})
+	}
+}
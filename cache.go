@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// sqlSummary is a cached summary. Entries are keyed by the model and the
+// normalized prompt that produced them. Prompt, the name of the template,
+// and PromptVersion are only kept to prune summaries of earlier templates.
+type sqlSummary struct {
+	Key           string `gorm:"primaryKey"`
+	BodyHash      string
+	Model         string
+	Prompt        string `gorm:"index:idx_summary_prompt_version"`
+	PromptVersion string `gorm:"index:idx_summary_prompt_version"`
+	Summary       string `gorm:"serializer:encrypted"`
+	CreatedAt     time.Time
+}
+
+// summaryKey returns the cache key of the summary model generates for the
+// rendered system prompt and prompt. Since the prompt includes the sender,
+// subject and date, identical bodies of different messages don't share a
+// summary.
+func summaryKey(model, system, prompt string) string {
+	return hashString(model + "\x00" + normalizeBody(system) + "\x00" + normalizeBody(prompt))
+}
+
+// normalizeBody makes messages that only differ in whitespace or line
+// endings hash the same.
+func normalizeBody(msg string) string {
+	return strings.Join(strings.Fields(msg), " ")
+}
+
+func hashString(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func (db *sqliteDB) cachedSummary(key string) (string, bool) {
+	var s sqlSummary
+	err := db.db.First(&s, "key = ?", key).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Could not read summary cache: %v", err)
+		}
+		summaryCacheLookups.WithLabelValues("miss").Inc()
+		return "", false
+	}
+	summaryCacheLookups.WithLabelValues("hit").Inc()
+	return s.Summary, true
+}
+
+func (db *sqliteDB) cacheSummary(s *sqlSummary) error {
+	return db.db.Save(s).Error
+}
+
+// pruneSummaries removes summaries that were made with an earlier version of
+// the prompt template and can't be hit anymore. Summaries of any model, bio
+// or account made with the template version are kept. Summaries from before
+// the template was recorded can't be hit either, and are removed as well.
+func (db *sqliteDB) pruneSummaries(prompt, templateVersion string) error {
+	prefix := templateVersion + "-"
+	return db.db.Where("prompt = '' OR (prompt = ? AND substr(prompt_version, 1, ?) <> ?)", prompt, len(prefix), prefix).
+		Delete(&sqlSummary{}).Error
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCachedSummary(t *testing.T) {
+	h := newHarness(t, "testdata/inbox", []scriptedReply{
+		{match: "alice@example.com", reply: "- Alice says thanks"},
+		{match: "bob@example.com", reply: "- Bob says thanks"},
+	})
+	mbox := h.app.mbox
+	newMessage := func(from string) *mailMessage {
+		c := &mailConversation{mailbox: mbox, subject: "Thanks"}
+		c.messages = []mailMessage{{conversation: c, from: from, date: "Mon, 1 Jul 2024 09:00:00 +0000", msg: "Thanks!"}}
+		return &c.messages[0]
+	}
+
+	tests := []struct {
+		from  string
+		want  string
+		calls int
+	}{
+		{"Alice <alice@example.com>", "- Alice says thanks", 1},
+		// The same body from another sender isn't served from the cache.
+		{"Bob <bob@example.com>", "- Bob says thanks", 2},
+		{"Alice <alice@example.com>", "- Alice says thanks", 2},
+	}
+	for _, test := range tests {
+		got, err := newMessage(test.from).cachedSummary(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("summary of the message from %s = %q, want %q", test.from, got, test.want)
+		}
+		if calls := len(h.llm.calls()); calls != test.calls {
+			t.Errorf("%d llm requests after the message from %s, want %d", calls, test.from, test.calls)
+		}
+	}
+}
+
+func TestPruneSummaries(t *testing.T) {
+	h := newHarness(t, "testdata/inbox", nil)
+	prompts := h.app.mbox.prompts
+	version := func(task string) string {
+		tmpl, err := prompts.get(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tmpl.version
+	}
+	entries := []struct {
+		summary sqlSummary
+		kept    bool
+	}{
+		{sqlSummary{Key: "current", Model: "a", Prompt: promptSummary, PromptVersion: version(promptSummary) + "-bio1"}, true},
+		{sqlSummary{Key: "other model and bio", Model: "b", Prompt: promptSummary, PromptVersion: version(promptSummary) + "-bio2"}, true},
+		{sqlSummary{Key: "other template", Model: "a", Prompt: promptActions, PromptVersion: version(promptActions) + "-bio1"}, true},
+		{sqlSummary{Key: "earlier version", Model: "a", Prompt: promptSummary, PromptVersion: "1-0000000-bio1"}, false},
+		{sqlSummary{Key: "earlier template version", Model: "a", Prompt: promptActions, PromptVersion: "1-0000000-bio1"}, false},
+		{sqlSummary{Key: "unrecorded template", Model: "a", PromptVersion: version(promptSummary) + "-bio1"}, false},
+	}
+	for _, e := range entries {
+		s := e.summary
+		s.Summary = "- " + s.Key
+		if err := h.store.cacheSummary(&s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newMailbox("test", nil, h.llm, prompts, h.store, "")
+	for _, e := range entries {
+		if _, ok := h.store.cachedSummary(e.summary.Key); ok != e.kept {
+			t.Errorf("%s kept = %v, want %v", e.summary.Key, ok, e.kept)
+		}
+	}
+}
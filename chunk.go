@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Messages that don't fit into the context of the model are summarized with
+// map-reduce: they're split into chunks on paragraph and quote boundaries,
+// every chunk is summarized on its own, and the prompt of the task is run on
+// the partial summaries.
+const (
+	// maxResponseTokens is the most of the context kept free for the
+	// response. Small contexts keep a quarter free instead.
+	maxResponseTokens = 1024
+	// minChunkTokens keeps chunks from getting uselessly small when the
+	// prompt itself takes up most of the context.
+	minChunkTokens = 256
+	// maxChunks limits the requests spent on a single message. The rest of
+	// the message is left out of the summary.
+	maxChunks = 16
+)
+
+// truncatedNote is appended to summaries that don't cover the whole message.
+const truncatedNote = "\n\n*The message was too long to summarize completely, the end of it was left out.*"
+
+// replyHeader starts the quoted or forwarded part of a message.
+var replyHeader = regexp.MustCompile(`(?i)^(on .+ wrote:|-+ ?(original|forwarded) message ?-+)$`)
+
+// messageBudget returns how many tokens of message fit into the prompt of the
+// task, leaving room for the response.
+func (mbox *mailBox) messageBudget(ai LLM, task string, data promptData) (int, error) {
+	data.Message = ""
+	system, prompt, err := mbox.render(task, data)
+	if err != nil {
+		return 0, err
+	}
+	size := ai.contextSize()
+	budget := size - min(size/4, maxResponseTokens) - ai.tokens(system) - ai.tokens(prompt)
+	return max(budget, minChunkTokens), nil
+}
+
+// generateLong works like generateWith, but summarizes the message in chunks
+// first if it doesn't fit into the context of ai. Only the final request is
+// streamed to delta.
+func (mbox *mailBox) generateLong(ctx context.Context, ai LLM, task string, data promptData, delta func(string)) (string, error) {
+	budget, err := mbox.messageBudget(ai, task, data)
+	if err != nil {
+		return "", err
+	}
+	if ai.tokens(data.Message) <= budget {
+		return mbox.generateWith(ctx, ai, task, data, delta)
+	}
+	chunkBudget, err := mbox.messageBudget(ai, promptChunk, data)
+	if err != nil {
+		return "", err
+	}
+
+	chunks := splitMessage(data.Message, chunkBudget, ai.tokens)
+	truncated := len(chunks) > maxChunks
+	if truncated {
+		chunks = chunks[:maxChunks]
+	}
+	parts, err := mbox.summarizeChunks(ctx, ai, data, chunks, false)
+	if err != nil {
+		return "", err
+	}
+	// Partial summaries that still don't fit are combined in rounds, as long
+	// as that makes them fewer.
+	for ai.tokens(joinParts(parts)) > budget {
+		groups := packTexts(parts, "\n\n", chunkBudget, ai.tokens)
+		if len(groups) >= len(parts) {
+			break
+		}
+		if parts, err = mbox.summarizeChunks(ctx, ai, data, groups, true); err != nil {
+			return "", err
+		}
+	}
+	combined := joinParts(parts)
+	if ai.tokens(combined) > budget {
+		combined = cutTokens(combined, budget, ai.tokens)
+		truncated = true
+	}
+
+	data.Message = combined
+	data.Chunked = true
+	summary, err := mbox.generateWith(ctx, ai, task, data, delta)
+	if err != nil {
+		return "", err
+	}
+	if !truncated {
+		longMessages.WithLabelValues("chunked").Inc()
+		return summary, nil
+	}
+	log.Printf("Message %q is too long for %s, summarized it partially", data.Subject, ai.name())
+	longMessages.WithLabelValues("truncated").Inc()
+	if delta != nil {
+		delta(truncatedNote)
+	}
+	return summary + truncatedNote, nil
+}
+
+// summarizeChunks summarizes every chunk of a message. combined tells the
+// model that the chunks are summaries themselves.
+func (mbox *mailBox) summarizeChunks(ctx context.Context, ai LLM, data promptData, chunks []string, combined bool) ([]string, error) {
+	parts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		data.Message = chunk
+		data.Chunked = combined
+		data.Part = i + 1
+		data.Parts = len(chunks)
+		part, err := mbox.generateWith(ctx, ai, promptChunk, data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("part %d of %d: %v", i+1, len(chunks), err)
+		}
+		parts[i] = strings.TrimSpace(part)
+	}
+	return parts, nil
+}
+
+// joinParts lists partial summaries in the order of the parts.
+func joinParts(parts []string) string {
+	var b strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "Part %d:\n%s", i+1, part)
+	}
+	return b.String()
+}
+
+// splitMessage splits text into chunks of at most budget tokens. Chunks end
+// on paragraph and quote boundaries where possible, then on lines, and only
+// overlong lines are cut in between.
+func splitMessage(text string, budget int, tokens func(string) int) []string {
+	pieces := []string{}
+	for _, block := range splitBlocks(text) {
+		if tokens(block) <= budget {
+			pieces = append(pieces, block)
+			continue
+		}
+		for _, line := range strings.Split(block, "\n") {
+			for tokens(line) > budget {
+				head := cutTokens(line, budget, tokens)
+				pieces = append(pieces, head)
+				line = strings.TrimSpace(line[len(head):])
+			}
+			if line != "" {
+				pieces = append(pieces, line)
+			}
+		}
+	}
+	return packTexts(pieces, "\n", budget, tokens)
+}
+
+// splitBlocks splits text into paragraphs. A change between quoted and
+// unquoted lines, or the header of a quoted or forwarded message, also starts
+// a new paragraph.
+func splitBlocks(text string) []string {
+	blocks := []string{}
+	var lines []string
+	quoted := false
+	flush := func() {
+		if len(lines) > 0 {
+			blocks = append(blocks, strings.Join(lines, "\n"))
+			lines = nil
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			flush()
+			continue
+		}
+		q := strings.HasPrefix(trimmed, ">")
+		if q != quoted || replyHeader.MatchString(trimmed) {
+			flush()
+		}
+		quoted = q
+		lines = append(lines, line)
+	}
+	flush()
+	return blocks
+}
+
+// packTexts joins consecutive texts with sep into as few groups of at most
+// budget tokens as possible. Texts over the budget make up a group of their
+// own.
+func packTexts(texts []string, sep string, budget int, tokens func(string) int) []string {
+	groups := []string{}
+	var group []string
+	n := 0
+	for _, t := range texts {
+		size := tokens(t)
+		if len(group) > 0 && n+tokens(sep)+size > budget {
+			groups = append(groups, strings.Join(group, sep))
+			group, n = nil, 0
+		}
+		if len(group) > 0 {
+			n += tokens(sep)
+		}
+		group = append(group, t)
+		n += size
+	}
+	if len(group) > 0 {
+		groups = append(groups, strings.Join(group, sep))
+	}
+	return groups
+}
+
+// cutTokens returns the longest start of text that fits into budget tokens,
+// cut after a space if there is one.
+func cutTokens(text string, budget int, tokens func(string) int) string {
+	runes := []rune(text)
+	n := len(runes) * budget / max(tokens(text), 1)
+	for n > 0 && tokens(string(runes[:n])) > budget {
+		n--
+	}
+	for n < len(runes) && tokens(string(runes[:n+1])) <= budget {
+		n++
+	}
+	if n == 0 {
+		// Make progress even if a single character is over the budget.
+		n = 1
+	}
+	head := string(runes[:n])
+	if n == len(runes) || runes[n-1] == ' ' {
+		return head
+	}
+	if i := strings.LastIndexByte(head, ' '); i > 0 {
+		return head[:i+1]
+	}
+	return head
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// countWords is a tokenizer that counts words, so budgets are easy to reason
+// about.
+func countWords(s string) int {
+	return len(strings.Fields(s))
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		budget int
+		want   []string
+	}{
+		{
+			name:   "fits",
+			text:   "one two three",
+			budget: 10,
+			want:   []string{"one two three"},
+		},
+		{
+			name:   "paragraphs",
+			text:   "one two three\n\nfour five\n\nsix seven eight",
+			budget: 5,
+			want:   []string{"one two three\nfour five", "six seven eight"},
+		},
+		{
+			name:   "quote boundary",
+			text:   "sure\n> can you make\n> it",
+			budget: 6,
+			want:   []string{"sure", "> can you make\n> it"},
+		},
+		{
+			name:   "reply header",
+			text:   "sounds good\nOn Mon, Bob wrote:\nsee you",
+			budget: 6,
+			want:   []string{"sounds good", "On Mon, Bob wrote:\nsee you"},
+		},
+		{
+			name:   "long paragraph splits on lines",
+			text:   "a b c\nd e f\ng h i",
+			budget: 6,
+			want:   []string{"a b c\nd e f", "g h i"},
+		},
+		{
+			name:   "long line is cut between words",
+			text:   "a b c d e f g",
+			budget: 3,
+			want:   []string{"a b c ", "d e f ", "g"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.text, tt.budget, countWords)
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("splitMessage() = %q, want %q", got, tt.want)
+			}
+			for _, chunk := range got {
+				if countWords(chunk) > tt.budget {
+					t.Errorf("chunk %q is over the budget of %d", chunk, tt.budget)
+				}
+			}
+		})
+	}
+}
+
+// partsLLM answers chunk prompts with a one word summary and records the
+// prompts it was sent.
+type partsLLM struct {
+	size    int
+	prompts []string
+}
+
+func (l *partsLLM) name() string { return "parts" }
+
+func (l *partsLLM) contextSize() int { return l.size }
+
+func (l *partsLLM) tokens(text string) int { return countWords(text) }
+
+func (l *partsLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	l.prompts = append(l.prompts, prompt)
+	if strings.Contains(prompt, "Summarize part") {
+		return fmt.Sprintf("summary%d", len(l.prompts)), nil
+	}
+	return "final", nil
+}
+
+func TestGenerateLong(t *testing.T) {
+	prompts, err := loadPrompts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paragraph := strings.Repeat("word ", 400)
+
+	tests := []struct {
+		name       string
+		paragraphs int
+		requests   int
+		truncated  bool
+	}{
+		{"short message", 1, 1, false},
+		{"chunked", 4, 5, false},
+		{"truncated", maxChunks + 4, maxChunks + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ai := &partsLLM{size: 1000}
+			mbox := newMailbox("test", nil, ai, prompts, nil, "")
+			msg := strings.TrimSpace(strings.Repeat(paragraph+"\n\n", tt.paragraphs))
+			got, err := mbox.generateLong(context.Background(), ai, promptSummary, promptData{Subject: "Long", Message: msg}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ai.prompts) != tt.requests {
+				t.Errorf("got %d requests, want %d", len(ai.prompts), tt.requests)
+			}
+			if strings.HasSuffix(got, truncatedNote) != tt.truncated {
+				t.Errorf("generateLong() = %q, truncated %v", got, tt.truncated)
+			}
+			if tt.requests > 1 {
+				final := ai.prompts[len(ai.prompts)-1]
+				if !strings.Contains(final, "Part 1:\nsummary1") || strings.Contains(final, "word") {
+					t.Errorf("final prompt doesn't combine the parts: %q", final)
+				}
+			}
+		})
+	}
+}
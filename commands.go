@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// commands are the subcommands of mailassist. Without a subcommand, the
+// assistant itself is started.
+var commands = map[string]func(args []string) error{
+	"preview": previewCommand,
+	"digest":  digestCommand,
+	"eval":    evalCommand,
+
+	"export-feedback": exportFeedbackCommand,
+
+	"rotate-key": rotateKeyCommand,
+}
+
+// previewCommand renders a prompt template against a stored message and
+// prints the result, without calling the LLM.
+func previewCommand(args []string) error {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	var (
+		promptsFlag     = fs.String("prompts", "", "directory with prompt templates that replace the built-in ones")
+		templateFlag    = fs.String("template", promptSummary, "template to render (summary, actions, reply or digest)")
+		idFlag          = fs.Uint("id", 0, "ID of the stored message (default: the latest message)")
+		bioFlag         = fs.String("bio", defaultBio, "who you are and what you care about")
+		accountFlag     = fs.String("account", "default", "name of the mail account")
+		instructionFlag = fs.String("instruction", "", "instruction for the reply template")
+		keyfileFlag     = fs.String("keyfile", "", "file with the encryption passphrase (default $MAILASSIST_PASSPHRASE)")
+	)
+	fs.Parse(args)
+
+	key, err := loadKey(*keyfileFlag)
+	if err != nil {
+		return err
+	}
+
+	prompts, err := loadPrompts(*promptsFlag)
+	if err != nil {
+		return err
+	}
+	t, err := prompts.get(*templateFlag)
+	if err != nil {
+		return err
+	}
+	store, err := newSqlite(dbFile, key)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	msg, err := store.getMessage(uint(*idFlag))
+	if err != nil {
+		return fmt.Errorf("could not load message: %v", err)
+	}
+	data := store.promptData(msg)
+	data.Bio = *bioFlag
+	data.Account = *accountFlag
+	data.Instruction = *instructionFlag
+	if data.Corrections, err = store.recentCorrections(*accountFlag, maxCorrections); err != nil {
+		return fmt.Errorf("could not load corrections: %v", err)
+	}
+	data.Summaries = []promptEntry{{
+		Sender:  msg.From,
+		Subject: msg.Subject,
+		Date:    msg.Date.Format(time.RFC1123Z),
+		Summary: msg.Summary,
+	}}
+
+	system, prompt, err := t.render(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "# %s (version %s), message %d\n\n--- system ---\n%s\n\n--- prompt ---\n%s\n",
+		t.name, t.version, msg.ID, system, prompt)
+	return nil
+}
+
+// digestCommand generates a digest of the stored summaries and prints it.
+func digestCommand(args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	var (
+		periodFlag  = fs.String("period", digestDaily, "period of the digest (daily or weekly)")
+		formatFlag  = fs.String("format", "markdown", "output format (markdown or html)")
+		modelFlag   = fs.String("model", "zephyr", "llm model (e.g. mistral, gpt-4, ...)")
+		llmFlag     = fs.String("llm", "ollama", "choose from openai or ollama")
+		tokenFlag   = fs.String("token", "XYZ", "some llm require tokem authentication")
+		promptsFlag = fs.String("prompts", "", "directory with prompt templates that replace the built-in ones")
+		bioFlag     = fs.String("bio", defaultBio, "who you are and what you care about")
+		accountFlag = fs.String("account", "default", "name of the mail account")
+		configFlag  = fs.String("config", "config.json", "configuration file with the smtp settings")
+		sendFlag    = fs.Bool("send", false, "mail the digest through the configured smtp server")
+		keyfileFlag = fs.String("keyfile", "", "file with the encryption passphrase (default $MAILASSIST_PASSPHRASE)")
+	)
+	fs.Parse(args)
+
+	key, err := loadKey(*keyfileFlag)
+	if err != nil {
+		return err
+	}
+	token := *tokenFlag
+	if !flagSetIn(fs, "token") {
+		if token, err = readOpenAIKey(key, token); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := loadConfig(*configFlag)
+	if err != nil {
+		return err
+	}
+	var mailer *smtpSender
+	if *sendFlag {
+		if cfg.SMTP == nil {
+			return fmt.Errorf("%s: no smtp server configured", *configFlag)
+		}
+		if mailer, err = newSMTPSender(*cfg.SMTP); err != nil {
+			return err
+		}
+	}
+
+	model := *modelFlag
+	if *llmFlag == "openai" && !flagSetIn(fs, "model") {
+		model = ""
+	}
+	ai, err := newLLM(*llmFlag, model, token, 0, 0)
+	if err != nil {
+		return err
+	}
+	ai = cfg.redacted(ai, *llmFlag, *accountFlag)
+	var fallback LLM
+	if cfg.Budget != nil && cfg.Budget.Fallback != "" {
+		c := cfg.LLMs[cfg.Budget.Fallback]
+		if fallback, err = newLLM(c.Backend, c.Model, token, c.Concurrency, c.Context); err != nil {
+			return err
+		}
+		fallback = cfg.redacted(fallback, c.Backend, *accountFlag)
+	}
+	prompts, err := loadPrompts(*promptsFlag)
+	if err != nil {
+		return err
+	}
+	store, err := newSqlite(dbFile, key)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	usage := newUsageTracker(store, cfg.Prices, cfg.Budget)
+	mbox := newMailbox(*accountFlag, nil, cfg.budgeted(ai, usage, fallback), prompts, nil, *bioFlag)
+	mbox.usage = usage
+	d, err := generateDigest(context.Background(), mbox, store, *periodFlag, time.Now())
+	if err != nil {
+		return err
+	}
+	if mailer != nil {
+		return mailer.send(context.Background(), d.title(), d.markdown, d.html())
+	}
+	switch *formatFlag {
+	case "markdown":
+		fmt.Fprintf(os.Stdout, "# %s\n\n%s\n", d.title(), d.markdown)
+	case "html":
+		fmt.Fprintf(os.Stdout, "<h1>%s</h1>\n%s", d.title(), d.html())
+	default:
+		return fmt.Errorf("unknown format %q", *formatFlag)
+	}
+	return nil
+}
+
+// evalCommand runs a labeled dataset of emails through an LLM and prompt
+// template and scores the results, so models and prompts can be compared.
+func evalCommand(args []string) error {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	var (
+		datasetFlag  = fs.String("dataset", "eval/golden.json", "labeled emails to evaluate")
+		modelFlag    = fs.String("model", "zephyr", "llm model (e.g. mistral, gpt-4, ...)")
+		llmFlag      = fs.String("llm", "ollama", "choose from openai or ollama")
+		tokenFlag    = fs.String("token", "XYZ", "some llm require tokem authentication")
+		contextFlag  = fs.Int("llm-context", 0, "context window of the model in tokens (default depends on the backend and model)")
+		promptsFlag  = fs.String("prompts", "", "directory with prompt templates that replace the built-in ones")
+		templateFlag = fs.String("template", promptSummary, "template of the summaries")
+		bioFlag      = fs.String("bio", defaultBio, "who you are and what you care about (default the bio of the dataset)")
+		accountFlag  = fs.String("account", "default", "name of the mail account, for redaction")
+		configFlag   = fs.String("config", "config.json", "configuration file with the redaction settings")
+		keyfileFlag  = fs.String("keyfile", "", "file with the encryption passphrase (default $MAILASSIST_PASSPHRASE)")
+		outFlag      = fs.String("out", "", "save the results to this file, to compare later runs with")
+		baselineFlag = fs.String("baseline", "", "results of an earlier run to compare with")
+	)
+	fs.Parse(args)
+
+	ds, err := loadEvalDataset(*datasetFlag)
+	if err != nil {
+		return err
+	}
+	var baseline *evalReport
+	if *baselineFlag != "" {
+		if baseline, err = loadEvalReport(*baselineFlag); err != nil {
+			return err
+		}
+	}
+	cfg, err := loadConfig(*configFlag)
+	if err != nil {
+		return err
+	}
+	key, err := loadKey(*keyfileFlag)
+	if err != nil {
+		return err
+	}
+	token := *tokenFlag
+	if !flagSetIn(fs, "token") {
+		if token, err = readOpenAIKey(key, token); err != nil {
+			return err
+		}
+	}
+	model := *modelFlag
+	if *llmFlag == "openai" && !flagSetIn(fs, "model") {
+		model = ""
+	}
+	ai, err := newLLM(*llmFlag, model, token, 0, *contextFlag)
+	if err != nil {
+		return err
+	}
+	prompts, err := loadPrompts(*promptsFlag)
+	if err != nil {
+		return err
+	}
+	bio := *bioFlag
+	if ds.Bio != "" && !flagSetIn(fs, "bio") {
+		bio = ds.Bio
+	}
+
+	mbox := newMailbox(*accountFlag, nil, cfg.redacted(ai, *llmFlag, *accountFlag), prompts, nil, bio)
+	version, err := mbox.promptVersion(*templateFlag)
+	if err != nil {
+		return err
+	}
+	report := &evalReport{
+		Model:    ai.name(),
+		Template: *templateFlag,
+		Version:  version,
+		Dataset:  *datasetFlag,
+		Time:     time.Now(),
+		Results:  evaluate(context.Background(), mbox, ds, *templateFlag, os.Stderr),
+	}
+	printEvalReport(os.Stdout, report, baseline)
+	if *outFlag != "" {
+		return writeJSONFile(*outFlag, report)
+	}
+	return nil
+}
+
+// exportFeedbackCommand writes the feedback on summaries as a dataset for the
+// eval command.
+func exportFeedbackCommand(args []string) error {
+	fs := flag.NewFlagSet("export-feedback", flag.ExitOnError)
+	var (
+		outFlag     = fs.String("out", "eval/feedback.json", "file to write the dataset to")
+		accountFlag = fs.String("account", "default", "name of the mail account")
+		bioFlag     = fs.String("bio", defaultBio, "who you are and what you care about, stored with the dataset")
+		keyfileFlag = fs.String("keyfile", "", "file with the encryption passphrase (default $MAILASSIST_PASSPHRASE)")
+	)
+	fs.Parse(args)
+
+	key, err := loadKey(*keyfileFlag)
+	if err != nil {
+		return err
+	}
+	store, err := newSqlite(dbFile, key)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	ds, skipped, err := store.exportFeedback(*accountFlag, *bioFlag)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(*outFlag, ds); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Exported %d messages to %s", len(ds.Cases), *outFlag)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stdout, ", skipped %d without a priority or missed action items", skipped)
+	}
+	fmt.Fprintln(os.Stdout)
+	return nil
+}
+
+// rotateKeyCommand encrypts the tokens, secrets and messages with a key
+// derived from a new passphrase. Data that isn't encrypted yet is encrypted
+// as well, so this is also how encryption is turned on for existing data.
+func rotateKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	var (
+		keyfileFlag    = fs.String("keyfile", "", "file with the current passphrase (default $MAILASSIST_PASSPHRASE)")
+		newKeyfileFlag = fs.String("new-keyfile", "", "file with the new passphrase (default $MAILASSIST_NEW_PASSPHRASE)")
+	)
+	fs.Parse(args)
+
+	oldKey, err := loadKey(*keyfileFlag)
+	if err != nil {
+		return fmt.Errorf("current key: %v", err)
+	}
+	pass, err := passphrase(*newKeyfileFlag, "MAILASSIST_NEW_PASSPHRASE")
+	if err != nil {
+		return err
+	}
+	if pass == "" {
+		return errors.New("set the new passphrase with -new-keyfile or $MAILASSIST_NEW_PASSPHRASE")
+	}
+	key, params, err := newKey(pass)
+	if err != nil {
+		return err
+	}
+
+	// Everything is decrypted before anything is written, so a wrong key
+	// doesn't leave some files encrypted with the new key.
+	files, err := filepath.Glob("token-*.json")
+	if err != nil {
+		return err
+	}
+	files = append([]string{"credentials.json", openAIKeyFile, "token.json"}, files...)
+	secrets := make(map[string][]byte)
+	for _, file := range files {
+		b, err := readSecretFile(oldKey, file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		secrets[file] = b
+	}
+
+	// The files are re-encrypted into staged copies, and only replace the
+	// originals once the new key parameters are in place. Until then, a
+	// crash or an error leaves everything readable with the old passphrase.
+	if err := writeJSONFile(pendingKeyParamsFile, params); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if err := recoverRotation(); err != nil {
+				log.Printf("Could not remove staged files: %v", err)
+			}
+		}
+	}()
+	for file, b := range secrets {
+		if err := writeSecretFile(key, file+stagedSuffix, b); err != nil {
+			return err
+		}
+	}
+	if err := stageDatabase(oldKey, key); err != nil {
+		return fmt.Errorf("could not re-encrypt database: %v", err)
+	}
+	if err := os.Rename(pendingKeyParamsFile, keyParamsFile); err != nil {
+		return err
+	}
+	committed = true
+	if err := recoverRotation(); err != nil {
+		return err
+	}
+	for file := range secrets {
+		fmt.Fprintf(os.Stdout, "Encrypted %s\n", file)
+	}
+	fmt.Fprintln(os.Stdout, "Encrypted the database, use the new passphrase from now on")
+	return nil
+}
+
+// stageDatabase re-encrypts a copy of the database from oldKey to newKey,
+// which recoverRotation puts in place.
+func stageDatabase(oldKey, newKey *cipherKey) error {
+	staged := dbFile + stagedSuffix
+	err := copyFile(staged, dbFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	store, err := newSqlite(staged, oldKey)
+	if err != nil {
+		return err
+	}
+	if err := store.reencrypt(oldKey, newKey); err != nil {
+		store.close()
+		return err
+	}
+	return store.close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// config is the optional configuration file of mailassist. Everything that
+// can be set with flags keeps using the flags.
+type config struct {
+	// LLMs are additional backends that rules can route messages to, by
+	// name.
+	LLMs map[string]llmConfig `json:"llms"`
+	// Rules are evaluated in order for every fetched message.
+	Rules []rule `json:"rules"`
+	// Digests are the scheduled digests.
+	Digests []digestSchedule `json:"digests"`
+	// SMTP is where digests and alerts are mailed to, if it's set.
+	SMTP *smtpConfig `json:"smtp"`
+	// Redact decides which LLM requests are redacted. Without it, requests
+	// to openai are.
+	Redact *redactConfig `json:"redact"`
+	// Prices replace the built-in prices of models, by model name.
+	Prices map[string]llmPrice `json:"prices"`
+	// Budget limits the monthly spending on LLM requests, if it's set.
+	Budget *budgetConfig `json:"budget"`
+	// Priority configures the priority score of messages.
+	Priority *priorityConfig `json:"priority"`
+
+	redactor *redactor
+}
+
+type llmConfig struct {
+	// Backend is either "ollama" or "openai".
+	Backend string `json:"backend"`
+	Model   string `json:"model"`
+	// Concurrency limits the number of concurrent requests to the backend.
+	Concurrency int `json:"concurrency"`
+	// Context overrides the context window of the model, in tokens.
+	Context int `json:"context"`
+}
+
+// loadConfig reads the configuration file. A missing file results in an
+// empty configuration.
+func loadConfig(file string) (*config, error) {
+	cfg := &config{}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		b = []byte("{}")
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if l := cfg.Rules[i].Actions.LLM; l != "" {
+			if _, ok := cfg.LLMs[l]; !ok {
+				return nil, fmt.Errorf("%s: rule %q uses unknown llm %q", file, cfg.Rules[i].Name, l)
+			}
+		}
+	}
+	for i := range cfg.Digests {
+		if err := cfg.Digests[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if cfg.Redact == nil {
+		c := defaultRedactConfig
+		cfg.Redact = &c
+	}
+	if cfg.redactor, err = newRedactor(cfg.Redact); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if cfg.Budget != nil {
+		if err := cfg.Budget.check(cfg.LLMs); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if cfg.Priority != nil {
+		if err := cfg.Priority.check(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if cfg.SMTP != nil {
+		if err := cfg.SMTP.check(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return cfg, nil
+}
+
+// budgeted wraps ai so it switches to fallback, or stops, once the budget is
+// spent, if there is a budget.
+func (c *config) budgeted(ai LLM, usage *usageTracker, fallback LLM) LLM {
+	if c.Budget == nil {
+		return ai
+	}
+	return newBudgetLLM(ai, usage, fallback)
+}
+
+// redacted wraps ai, the backend for the account, so personal data is
+// redacted from its requests, if the config requires it.
+func (c *config) redacted(ai LLM, backend, account string) LLM {
+	if c.redactor == nil || !c.Redact.applies(backend, account) {
+		return ai
+	}
+	return newRedactingLLM(ai, c.redactor)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"gorm.io/gorm/schema"
+)
+
+// keyParamsFile holds the salt and KDF parameters the encryption key is
+// derived with. It isn't secret, but without it the key can't be derived.
+const keyParamsFile = "mailassist.keys"
+
+// A key rotation stages the re-encrypted files next to the originals, with
+// stagedSuffix, and the parameters of the new key in pendingKeyParamsFile.
+// Renaming pendingKeyParamsFile to keyParamsFile commits the rotation, see
+// recoverRotation.
+const (
+	pendingKeyParamsFile = keyParamsFile + ".pending"
+	stagedSuffix         = ".rotating"
+)
+
+// sealedPrefix marks encrypted values, so plaintext written before
+// encryption was enabled can still be read.
+const sealedPrefix = "enc:v1:"
+
+// keyCheck is encrypted into the key parameters to detect wrong passphrases.
+const keyCheck = "mailassist"
+
+// cipherKey encrypts secrets, tokens and message bodies with AES-256-GCM. A
+// nil *cipherKey leaves everything in plaintext.
+type cipherKey struct {
+	aead cipher.AEAD
+}
+
+type keyParams struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	// Check is keyCheck encrypted with the key.
+	Check string `json:"check"`
+}
+
+// passphrase returns the passphrase in keyfile, or in the environment
+// variable env if keyfile isn't set. It returns "" if there is none.
+func passphrase(keyfile, env string) (string, error) {
+	if keyfile != "" {
+		b, err := os.ReadFile(keyfile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return os.Getenv(env), nil
+}
+
+// loadKey derives the encryption key from the passphrase in keyfile or
+// $MAILASSIST_PASSPHRASE. Without a passphrase, it returns nil and data is
+// stored in plaintext.
+func loadKey(keyfile string) (*cipherKey, error) {
+	if err := recoverRotation(); err != nil {
+		return nil, fmt.Errorf("could not recover interrupted key rotation: %v", err)
+	}
+	pass, err := passphrase(keyfile, "MAILASSIST_PASSPHRASE")
+	if err != nil || pass == "" {
+		return nil, err
+	}
+	b, err := os.ReadFile(keyParamsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, params, err := newKey(pass)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeJSONFile(keyParamsFile, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var params keyParams
+	if err := json.Unmarshal(b, &params); err != nil {
+		return nil, fmt.Errorf("%s: %v", keyParamsFile, err)
+	}
+	return deriveKey(pass, &params)
+}
+
+// recoverRotation finishes or undoes a key rotation that was interrupted.
+// Until the rotation is committed, the staged files are removed and the
+// original files, which are still encrypted with the old key, are kept. Once
+// it's committed, the staged files replace the originals.
+func recoverRotation() error {
+	if _, err := os.Stat(pendingKeyParamsFile); err == nil {
+		// The glob includes the journal of a staged database.
+		staged, err := filepath.Glob("*" + stagedSuffix + "*")
+		if err != nil {
+			return err
+		}
+		for _, file := range staged {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+		return os.Remove(pendingKeyParamsFile)
+	}
+	staged, err := filepath.Glob("*" + stagedSuffix)
+	if err != nil {
+		return err
+	}
+	for _, file := range staged {
+		if err := os.Rename(file, strings.TrimSuffix(file, stagedSuffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newKey derives a key from the passphrase with a new salt.
+func newKey(pass string) (*cipherKey, *keyParams, error) {
+	params := &keyParams{
+		KDF:     "argon2id",
+		Salt:    make([]byte, 16),
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+	}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, nil, err
+	}
+	key, err := deriveKey(pass, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	if params.Check, err = key.encrypt([]byte(keyCheck)); err != nil {
+		return nil, nil, err
+	}
+	return key, params, nil
+}
+
+func deriveKey(pass string, params *keyParams) (*cipherKey, error) {
+	if params.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported kdf %q", params.KDF)
+	}
+	block, err := aes.NewCipher(argon2.IDKey([]byte(pass), params.Salt, params.Time, params.Memory, params.Threads, 32))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	key := &cipherKey{aead: aead}
+	if params.Check != "" {
+		if check, err := key.decrypt(params.Check); err != nil || string(check) != keyCheck {
+			return nil, errors.New("wrong passphrase")
+		}
+	}
+	return key, nil
+}
+
+// sealed reports whether the value was encrypted.
+func sealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// encrypt returns the sealed form of plaintext, or plaintext itself when
+// key is nil.
+func (key *cipherKey) encrypt(plaintext []byte) (string, error) {
+	if key == nil {
+		return string(plaintext), nil
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealedValue := key.aead.Seal(nonce, nonce, plaintext, nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealedValue), nil
+}
+
+// decrypt opens a value returned by encrypt. Values that aren't sealed are
+// returned as they are.
+func (key *cipherKey) decrypt(value string) ([]byte, error) {
+	if !sealed(value) {
+		return []byte(value), nil
+	}
+	if key == nil {
+		return nil, errors.New("data is encrypted, set $MAILASSIST_PASSPHRASE or -keyfile")
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil {
+		return nil, err
+	}
+	n := key.aead.NonceSize()
+	if len(b) < n {
+		return nil, errors.New("encrypted value too short")
+	}
+	plaintext, err := key.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt, wrong key?")
+	}
+	return plaintext, nil
+}
+
+// readSecretFile reads a file that might be encrypted.
+func readSecretFile(key *cipherKey, path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil || !sealed(string(b)) {
+		return b, err
+	}
+	plaintext, err := key.decrypt(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return plaintext, nil
+}
+
+// writeSecretFile encrypts data with key and writes it to path.
+func writeSecretFile(key *cipherKey, path string, data []byte) error {
+	s, err := key.encrypt(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(s))
+}
+
+// writeJSONFile writes v as JSON to path.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic writes data to a file that only the user can read. The
+// file is replaced atomically, so a crash can't leave a truncated file
+// behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// copyFile copies src to a new file dst that only the user can read.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// encryptedSerializer is the gorm serializer of encrypted string columns.
+// Empty strings are stored as they are, so they can still be queried.
+type encryptedSerializer struct {
+	key *cipherKey
+}
+
+func (s encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("unexpected encrypted value %T", dbValue)
+	}
+	plaintext, err := s.key.decrypt(value)
+	if err != nil {
+		return err
+	}
+	field.ReflectValueOf(ctx, dst).SetString(string(plaintext))
+	return nil
+}
+
+func (s encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	value, _ := fieldValue.(string)
+	if value == "" {
+		return "", nil
+	}
+	return s.key.encrypt([]byte(value))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chdirTemp changes into a temporary directory for the rest of the test,
+// since the key parameters and secrets live in the working directory.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestCipherKey(t *testing.T) {
+	key, params, err := newKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"", "hello", "Grüße, 你好\n"} {
+		sealedValue, err := key.encrypt([]byte(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sealed(sealedValue) || strings.Contains(sealedValue, "hello") {
+			t.Errorf("encrypt(%q) = %q", plaintext, sealedValue)
+		}
+		got, err := key.decrypt(sealedValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != plaintext {
+			t.Errorf("decrypt(encrypt(%q)) = %q", plaintext, got)
+		}
+	}
+
+	// Values written before encryption was enabled are read as they are.
+	if got, err := key.decrypt("plain"); err != nil || string(got) != "plain" {
+		t.Errorf("decrypt(plain) = %q, %v", got, err)
+	}
+	var none *cipherKey
+	if got, err := none.encrypt([]byte("plain")); err != nil || got != "plain" {
+		t.Errorf("encrypt without a key = %q, %v", got, err)
+	}
+
+	sealedValue, err := key.encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := none.decrypt(sealedValue); err == nil {
+		t.Error("decrypted without a key")
+	}
+	other, _, err := newKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.decrypt(sealedValue); err == nil {
+		t.Error("decrypted with a key with another salt")
+	}
+
+	if _, err := deriveKey("wrong horse", params); err == nil || err.Error() != "wrong passphrase" {
+		t.Errorf("deriveKey() with the wrong passphrase = %v", err)
+	}
+	again, err := deriveKey("correct horse", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := again.decrypt(sealedValue); err != nil || string(got) != "secret" {
+		t.Errorf("derived key decrypts %q, %v", got, err)
+	}
+}
+
+// rawColumn returns a column of the stored message as it is in the database.
+func rawColumn(t *testing.T, store *sqliteDB, column string, id uint) string {
+	t.Helper()
+	var value string
+	if err := store.db.Raw("SELECT `"+column+"` FROM sql_messages WHERE id = ?", id).Scan(&value).Error; err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestEncryptedDatabase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), dbFile)
+	store, err := newSqlite(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := sqlMessage{Subject: "legacy", Original: "plain body", Summary: "plain summary"}
+	if err := store.db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	key, _, err := newKey("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store, err = newSqlite(file, key); err != nil {
+		t.Fatal(err)
+	}
+	// Rows written before encryption was enabled are still read.
+	m, err := store.getMessage(legacy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Original != "plain body" || m.Summary != "plain summary" {
+		t.Errorf("legacy row read as %q, %q", m.Original, m.Summary)
+	}
+	current := sqlMessage{Subject: "current", Original: "new body", Summary: "new summary"}
+	if err := store.db.Create(&current).Error; err != nil {
+		t.Fatal(err)
+	}
+	if raw := rawColumn(t, store, "original", current.ID); !sealed(raw) {
+		t.Errorf("new row stored as %q", raw)
+	}
+
+	// Rotating encrypts the legacy rows as well.
+	next, _, err := newKey("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reencrypt(key, next); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint{legacy.ID, current.ID} {
+		for _, column := range []string{"original", "summary"} {
+			raw := rawColumn(t, store, column, id)
+			if _, err := key.decrypt(raw); err == nil {
+				t.Errorf("%s of %d can still be decrypted with the old key", column, id)
+			}
+			if _, err := next.decrypt(raw); err != nil {
+				t.Errorf("%s of %d: %v", column, id, err)
+			}
+		}
+	}
+	// A wrong old key fails without changing anything.
+	if err := store.reencrypt(key, nil); err == nil {
+		t.Error("reencrypt() with the wrong key succeeded")
+	}
+	store.close()
+
+	if store, err = newSqlite(file, next); err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if m, err = store.getMessage(current.ID); err != nil || m.Original != "new body" {
+		t.Errorf("rotated row read as %+v, %v", m, err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dir := chdirTemp(t)
+	t.Setenv("MAILASSIST_PASSPHRASE", "")
+	t.Setenv("MAILASSIST_NEW_PASSPHRASE", "new passphrase")
+	if err := os.WriteFile("token.json", []byte(`{"access_token":"abc"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newSqlite(dbFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.db.Create(&sqlMessage{Subject: "hi", Original: "body"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	if err := rotateKeyCommand(nil); err != nil {
+		t.Fatal(err)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dir, "*"+stagedSuffix+"*")); len(staged) != 0 {
+		t.Errorf("staged files left behind: %q", staged)
+	}
+	keyfile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(keyfile, []byte("new passphrase\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadKey(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := os.ReadFile("token.json"); !sealed(string(raw)) {
+		t.Errorf("token.json = %q", raw)
+	}
+	if b, err := readSecretFile(key, "token.json"); err != nil || string(b) != `{"access_token":"abc"}` {
+		t.Errorf("token.json decrypted to %q, %v", b, err)
+	}
+	if store, err = newSqlite(dbFile, key); err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if m, err := store.getMessage(0); err != nil || m.Original != "body" {
+		t.Errorf("message read as %+v, %v", m, err)
+	}
+}
+
+func TestRecoverRotation(t *testing.T) {
+	chdirTemp(t)
+	write := func(file, data string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(file string) string {
+		t.Helper()
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Interrupted before the commit: the originals are kept.
+	write(keyParamsFile, "old params")
+	write("token.json", "old token")
+	write(pendingKeyParamsFile, "new params")
+	write("token.json"+stagedSuffix, "new token")
+	write(dbFile+stagedSuffix+"-journal", "journal")
+	if err := recoverRotation(); err != nil {
+		t.Fatal(err)
+	}
+	if read(keyParamsFile) != "old params" || read("token.json") != "old token" {
+		t.Error("rolling back changed the originals")
+	}
+	if left, _ := filepath.Glob("*.*"); len(left) != 2 {
+		t.Errorf("rolling back left %q", left)
+	}
+
+	// Interrupted after the commit: the staged files replace the originals.
+	write(keyParamsFile, "new params")
+	write("token.json"+stagedSuffix, "new token")
+	if err := recoverRotation(); err != nil {
+		t.Fatal(err)
+	}
+	if read("token.json") != "new token" {
+		t.Error("rolling forward didn't replace the original")
+	}
+	if _, err := os.Stat("token.json" + stagedSuffix); err == nil {
+		t.Error("rolling forward left the staged file")
+	}
+}
@@ -2,65 +2,81 @@ package main
 
 import (
 	"fmt"
-	"hash/crc32"
+	"log"
+	"net/mail"
 	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 )
 
+// hashMail identifies messages that have neither a Message-ID nor a provider
+// ID.
 func hashMail(date, from, subject string) string {
-	str := date + from + subject
-	h := crc32.ChecksumIEEE([]byte(str))
-	return fmt.Sprintf("%X", h)
+	return hashString(date + "\x00" + from + "\x00" + subject)[:16]
 }
 
-type localDB struct {
-	read []string
-}
+type sqlMessage struct {
+	ID         uint
+	MessageID  string `gorm:"index"`
+	ProviderID string `gorm:"index"`
+	Date       time.Time
+	From       string
+	Subject    string
 
-func newLocalDB() *localDB {
-	return &localDB{}
-}
+	// Threading, for replies
+	ThreadID   string
+	References string
+	ReplyTo    string
 
-func (db *localDB) wasRead(hash string) bool {
-	for i := range db.read {
-		if db.read[i] == hash {
-			return true
-		}
-	}
-	return false
-}
-func (db *localDB) markRead(hash string) {
-	db.read = append(db.read, hash)
-}
-
-type sqlMessage struct {
-	ID      uint
-	Date    time.Time
-	From    string
-	Subject string
+	// Bodies are encrypted when a passphrase is set.
+	Summary  string `gorm:"serializer:encrypted"`
+	Original string `gorm:"serializer:encrypted"`
 
-	Summary  string
-	Original string
+	// Model and PromptVersion made the summary, for feedback on it.
+	Model         string
+	PromptVersion string
 
 	// Metadata
-	Tags    []string
-	Deleted bool
+	Priority string
+	// Score is the priority score, from 0 to 100, and ScoreReasons the
+	// signals it's made of.
+	Score        int      `gorm:"index"`
+	ScoreReasons []string `gorm:"serializer:json"`
+	Tags         []string `gorm:"serializer:json"`
+	Deleted      bool
+
+	// Bulk mail
+	Bulk         bool
+	Unsubscribe  string
+	OneClick     bool
+	Unsubscribed bool
 }
 type sqliteDB struct {
 	db          *gorm.DB
 	showDeleted bool
 }
 
-func newSqlite() (*sqliteDB, error) {
-	db, err := gorm.Open(sqlite.Open("mailassist.db"), &gorm.Config{})
+// dbFile is the database in the working directory.
+const dbFile = "mailassist.db"
+
+// newSqlite opens the database in file. Message bodies and summaries are
+// encrypted with key, unless it's nil.
+func newSqlite(file string, key *cipherKey) (*sqliteDB, error) {
+	schema.RegisterSerializer("encrypted", encryptedSerializer{key: key})
+	db, err := gorm.Open(sqlite.Open(file), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
 
 	// Migrate the schema
-	db.AutoMigrate(&sqlMessage{})
+	if err := db.AutoMigrate(&sqlMessage{}, &sqlSummary{}, &sqlUsage{}, &sqlFeedback{}); err != nil {
+		return nil, err
+	}
+	if err := migrateDates(db); err != nil {
+		return nil, fmt.Errorf("could not migrate message dates: %v", err)
+	}
 	/*
 		// Create
 		db.Create(&Product{Code: "D42", Price: 100})
@@ -84,26 +100,244 @@ func newSqlite() (*sqliteDB, error) {
 	}, nil
 }
 
-func (db *sqliteDB) saveMessage(date, from, subject, message, original string) error {
+// migrateDates converts the dates of messages stored with the sender's UTC
+// offset to UTC. sqlite compares dates as text, so they're only ordered
+// correctly when they're all in the same zone.
+func migrateDates(db *gorm.DB) error {
+	var rows []struct {
+		ID   uint
+		Date time.Time
+	}
+	if err := db.Table("sql_messages").Select("id, date").Where("date NOT LIKE ?", "%+00:00").
+		Find(&rows).Error; err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, r := range rows {
+			if err := tx.Table("sql_messages").Where("id = ?", r.ID).Update("date", r.Date.UTC()).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *sqliteDB) saveMessage(m *mailMessage, summary string) error {
 	// Fri, 29 Mar 2024 17:48:24 +0000 (UTC)
-	// Mon Jan 2 15:04:05 MST 2006
-	d, err := time.Parse("Mon, 02 Jan 2006 15:04:05 +0000 (MST)", date)
+	d, err := mail.ParseDate(m.date)
+	if err != nil {
+		// The message is still stored, since it also serves as the read
+		// marker.
+		d = time.Now()
+	}
+	bulk := m.bulk
+	if bulk == nil {
+		bulk = &bulkInfo{}
+	}
+	priority := m.priority
+	if priority.Level == "" {
+		// Messages that aren't summarized keep the priority of the rules.
+		priority.Level = m.actions.Priority
+	}
+	var model, version string
+	if summary != "" {
+		model = m.llm().name()
+		version, _ = m.conversation.mailbox.promptVersion(m.summaryPrompt())
+	}
+	return db.db.Create(&sqlMessage{
+		MessageID:     m.messageID,
+		ProviderID:    m.providerID,
+		Date:          d.UTC(),
+		From:          m.from,
+		Subject:       m.conversation.subject,
+		ThreadID:      m.threadID,
+		References:    m.header["References"],
+		ReplyTo:       m.header["Reply-To"],
+		Original:      m.msg,
+		Summary:       summary,
+		Model:         model,
+		PromptVersion: version,
+		Priority:      priority.Level,
+		Score:         priority.Score,
+		ScoreReasons:  priority.Reasons,
+		Tags:          m.actions.Tags,
+		Bulk:          m.bulk != nil,
+		Unsubscribe:   bulk.unsubscribe,
+		OneClick:      bulk.oneClick,
+	}).Error
+}
+
+// wasRead reports whether the message was already stored. Messages are
+// matched on their Message-ID or provider ID.
+//
+// Messages stored before IDs were recorded are matched on their headers
+// instead, and get the IDs of m filled in, so they are found by ID from then
+// on. Messages without IDs are always matched on their headers.
+func (db *sqliteDB) wasRead(m *mailMessage) bool {
+	var found []sqlMessage
+	if m.messageID != "" {
+		db.db.Where("message_id = ?", m.messageID).Limit(1).Find(&found)
+	}
+	if len(found) == 0 && m.providerID != "" {
+		db.db.Where("provider_id = ?", m.providerID).Limit(1).Find(&found)
+	}
+	if len(found) > 0 {
+		return true
+	}
+
+	hasID := m.messageID != "" || m.providerID != ""
+	query := db.db.Where("message_id = '' AND provider_id = '' AND `from` = ? AND subject = ?",
+		m.from, m.conversation.subject)
+	// Messages without a date are stored with the time they were read. Without
+	// IDs, the sender and subject are all there is to match them on. With
+	// IDs, they're summarized once more and found by ID afterwards.
+	if d, err := mail.ParseDate(m.date); err == nil {
+		query = query.Where("date = ?", d.UTC())
+	} else if hasID {
+		return false
+	}
+	query.Limit(1).Find(&found)
+	if len(found) == 0 {
+		return false
+	}
+	if !hasID {
+		return true
+	}
+	if err := db.db.Model(&found[0]).Updates(sqlMessage{
+		MessageID:  m.messageID,
+		ProviderID: m.providerID,
+	}).Error; err != nil {
+		log.Printf("Could not migrate read marker of %q: %v", m.conversation.subject, err)
+	}
+	return true
+}
+
+// close flushes pending writes and closes the database.
+func (db *sqliteDB) close() error {
+	sqlDB, err := db.db.DB()
 	if err != nil {
 		return err
 	}
-	db.db.Create(&sqlMessage{
-		Date:     d,
-		From:     from,
-		Subject:  subject,
-		Original: original,
-		Summary:  message,
-	})
-	return nil
+	return sqlDB.Close()
 }
-func (db *sqliteDB) getMessages(from, to time.Time) []sqlMessage {
-	return []sqlMessage{}
+
+// getMessage returns the stored message with the ID, or the latest message
+// when id is 0.
+func (db *sqliteDB) getMessage(id uint) (*sqlMessage, error) {
+	var m sqlMessage
+	if id == 0 {
+		return &m, db.db.Order("id DESC").First(&m).Error
+	}
+	return &m, db.db.First(&m, id).Error
+}
+
+// findMessage returns the stored message with the Message-ID or provider ID.
+func (db *sqliteDB) findMessage(id string) (*sqlMessage, error) {
+	var m sqlMessage
+	if id == "" {
+		// Would match every message without one of the IDs.
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &m, db.db.Where("message_id = ? OR provider_id = ?", id, id).Order("id DESC").First(&m).Error
+}
+
+// promptData returns the template variables describing a stored message. The
+// participants are collected from the stored messages with the same subject.
+func (db *sqliteDB) promptData(m *sqlMessage) promptData {
+	var conversation []sqlMessage
+	db.db.Where("subject = ?", m.Subject).Order("date").Find(&conversation)
+	participants := []string{}
+	for i := range conversation {
+		if !contains(participants, conversation[i].From) {
+			participants = append(participants, conversation[i].From)
+		}
+	}
+	return promptData{
+		Sender:       m.From,
+		Subject:      m.Subject,
+		Date:         m.Date.Format(time.RFC1123Z),
+		Participants: participants,
+		Message:      m.Original,
+	}
+}
+
+// getNewsletters returns the bulk mail stored since the time.
+func (db *sqliteDB) getNewsletters(since time.Time) ([]sqlMessage, error) {
+	var msgs []sqlMessage
+	return msgs, db.db.Where("bulk AND date >= ?", since.UTC()).Order("date DESC").Find(&msgs).Error
+}
+
+// markUnsubscribed records that the user unsubscribed from the sender of
+// the stored message.
+func (db *sqliteDB) markUnsubscribed(m *sqlMessage) error {
+	return db.db.Model(&sqlMessage{}).Where("bulk AND `from` = ?", m.From).Update("unsubscribed", true).Error
+}
+
+// getMessages returns the summarized messages stored between from and to,
+// oldest first.
+func (db *sqliteDB) getMessages(from, to time.Time) ([]sqlMessage, error) {
+	var msgs []sqlMessage
+	return msgs, db.db.Where("NOT bulk AND NOT deleted AND summary <> '' AND date >= ? AND date < ?", from.UTC(), to.UTC()).
+		Order("date").Find(&msgs).Error
+}
+
+// getSummaries returns up to limit summarized messages stored since the time
+// with at least the priority score, newest first or, if byScore is set,
+// highest score first.
+func (db *sqliteDB) getSummaries(since time.Time, minScore int, byScore bool, limit int) ([]sqlMessage, error) {
+	order := "date DESC"
+	if byScore {
+		order = "score DESC, date DESC"
+	}
+	var msgs []sqlMessage
+	return msgs, db.db.Where("NOT bulk AND NOT deleted AND summary <> '' AND date >= ? AND score >= ?", since.UTC(), minScore).
+		Order(order).Limit(limit).Find(&msgs).Error
 }
 
 func (db *sqliteDB) getTags(tags []string) []sqlMessage {
 	return []sqlMessage{}
 }
+
+// reencrypt decrypts the encrypted columns with oldKey and encrypts them with
+// newKey, in a single transaction. Either key can be nil for plaintext.
+func (db *sqliteDB) reencrypt(oldKey, newKey *cipherKey) error {
+	// The serializer of the columns is bound to the key the database was
+	// opened with, so the columns are rewritten with plain SQL.
+	columns := []struct{ table, id, column string }{
+		{"sql_messages", "id", "original"},
+		{"sql_messages", "id", "summary"},
+		{"sql_summaries", "key", "summary"},
+		{"sql_feedbacks", "id", "action_item"},
+	}
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		for _, c := range columns {
+			var rows []struct{ ID, Value string }
+			if err := tx.Raw("SELECT `" + c.id + "` AS id, `" + c.column + "` AS value FROM " + c.table).
+				Scan(&rows).Error; err != nil {
+				return err
+			}
+			for _, r := range rows {
+				if r.Value == "" {
+					continue
+				}
+				plaintext, err := oldKey.decrypt(r.Value)
+				if err != nil {
+					return fmt.Errorf("%s %s: %v", c.table, r.ID, err)
+				}
+				value, err := newKey.encrypt(plaintext)
+				if err != nil {
+					return err
+				}
+				if err := tx.Exec("UPDATE "+c.table+" SET `"+c.column+"` = ? WHERE `"+c.id+"` = ?", value, r.ID).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Rewrite the file, so the old values don't linger in free pages.
+	return db.db.Exec("VACUUM").Error
+}
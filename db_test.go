@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessageDates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), dbFile)
+	store, err := newSqlite(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages used to be stored with the UTC offset of the sender.
+	berlin := time.FixedZone("CEST", 2*60*60)
+	newYork := time.FixedZone("EDT", -4*60*60)
+	for _, m := range []sqlMessage{
+		{Subject: "early", Date: time.Date(2024, 7, 1, 23, 30, 0, 0, berlin)},
+		{Subject: "late", Date: time.Date(2024, 7, 1, 20, 30, 0, 0, newYork)},
+	} {
+		m.Summary = "- " + m.Subject
+		if err := store.db.Create(&m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.close()
+
+	store, err = newSqlite(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	tests := []struct {
+		from, to time.Time
+		want     []string
+	}{
+		{time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC), []string{"early"}},
+		{time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 3, 0, 0, 0, 0, time.UTC), []string{"late"}},
+		{time.Date(2024, 7, 1, 17, 0, 0, 0, newYork), time.Date(2024, 7, 2, 6, 0, 0, 0, berlin), []string{"early", "late"}},
+	}
+	for _, tt := range tests {
+		msgs, err := store.getMessages(tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, m := range msgs {
+			got = append(got, m.Subject)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getMessages(%v, %v) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestWasRead(t *testing.T) {
+	store, err := newSqlite(filepath.Join(t.TempDir(), dbFile), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	newMessage := func(messageID, providerID, date string) *mailMessage {
+		c := &mailConversation{subject: "Weekly report"}
+		c.messages = []mailMessage{{conversation: c, messageID: messageID, providerID: providerID,
+			from: "Alice <alice@example.com>", date: date}}
+		return &c.messages[0]
+	}
+	const date = "Mon, 1 Jul 2024 09:00:00 +0200"
+
+	// Messages used to be stored without their IDs.
+	legacy := sqlMessage{Date: time.Date(2024, 7, 1, 7, 0, 0, 0, time.UTC), From: "Alice <alice@example.com>", Subject: "Weekly report"}
+	if err := store.db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !store.wasRead(newMessage("<1@example.com>", "p1", date)) {
+		t.Fatal("legacy message wasn't matched on its headers")
+	}
+	m, err := store.findMessage("<1@example.com>")
+	if err != nil || m.ID != legacy.ID || m.ProviderID != "p1" {
+		t.Fatalf("legacy message found as %+v, %v", m, err)
+	}
+	// Once it has IDs, it isn't matched on its headers anymore.
+	if store.wasRead(newMessage("<2@example.com>", "p2", date)) {
+		t.Error("another message with the same headers was matched")
+	}
+	if !store.wasRead(newMessage("", "p1", "")) {
+		t.Error("migrated message wasn't found by its provider ID")
+	}
+
+	// Messages without IDs or a date are read once.
+	undated := newMessage("", "", "someday")
+	if store.wasRead(undated) {
+		t.Fatal("unread message without IDs or a date was matched")
+	}
+	if err := store.saveMessage(undated, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !store.wasRead(undated) {
+		t.Error("stored message without IDs or a date wasn't matched")
+	}
+}
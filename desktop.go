@@ -5,6 +5,12 @@ import (
 	"os/exec"
 )
 
+// notifier shows notifications to the user.
+type notifier interface {
+	notify(msg string) error
+}
+
+// desktop shows notifications with notify-send.
 type desktop struct {
 	notifications bool
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Digest periods.
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+// digest is a briefing of the messages stored in a period.
+type digest struct {
+	period   string
+	from, to time.Time
+	messages int
+	markdown string
+}
+
+// title returns the title of the digest, e.g. "Daily digest, Mon 2 Jan".
+func (d *digest) title() string {
+	return fmt.Sprintf("%s digest, %s", strings.ToUpper(d.period[:1])+d.period[1:], d.to.Format("Mon 2 Jan"))
+}
+
+// html returns the digest rendered as sanitized HTML.
+func (d *digest) html() string {
+	return sanitizeHTML(highlightPriority(markdownMessage(d.markdown)))
+}
+
+// digestRange returns the period covered by a digest generated at now.
+func digestRange(period string, now time.Time) (time.Time, time.Time, error) {
+	switch period {
+	case digestDaily:
+		return now.AddDate(0, 0, -1), now, nil
+	case digestWeekly:
+		return now.AddDate(0, 0, -7), now, nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown digest period %q", period)
+}
+
+// priorityRank orders messages by priority, highest first.
+func priorityRank(priority string) int {
+	switch priority {
+	case "high":
+		return 0
+	case "med":
+		return 1
+	case "low":
+		return 2
+	}
+	return 3
+}
+
+// generateDigest asks the LLM for a briefing of the summaries stored in the
+// period before now.
+func generateDigest(ctx context.Context, mbox *mailBox, store *sqliteDB, period string, now time.Time) (*digest, error) {
+	from, to, err := digestRange(period, now)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := store.getMessages(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("could not load messages: %v", err)
+	}
+	d := &digest{period: period, from: from, to: to, messages: len(msgs)}
+	if len(msgs) == 0 {
+		d.markdown = "No new messages."
+		return d, nil
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if ri, rj := priorityRank(msgs[i].Priority), priorityRank(msgs[j].Priority); ri != rj {
+			return ri < rj
+		}
+		return msgs[i].Score > msgs[j].Score
+	})
+	entries := []promptEntry{}
+	for _, m := range msgs {
+		entries = append(entries, promptEntry{
+			Sender:   m.From,
+			Subject:  m.Subject,
+			Date:     m.Date.Format(time.RFC1123Z),
+			Priority: m.Priority,
+			Summary:  m.Summary,
+		})
+	}
+	d.markdown, err = mbox.briefing(ctx, entries)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// briefing asks the LLM for a briefing of the entries. Entries that don't fit
+// into the context of the model at once are briefed in batches, and the
+// briefings of the batches are combined, the way long messages are
+// summarized in chunks.
+func (mbox *mailBox) briefing(ctx context.Context, entries []promptEntry) (string, error) {
+	ai := mbox.ai
+	budget, err := mbox.messageBudget(ai, promptDigest, promptData{})
+	if err != nil {
+		return "", err
+	}
+	batches, err := mbox.digestBatches(ai, entries, budget)
+	if err != nil {
+		return "", err
+	}
+	if len(batches) == 1 {
+		return mbox.generate(ctx, promptDigest, promptData{Summaries: entries}, nil)
+	}
+
+	parts := make([]string, len(batches))
+	for i, batch := range batches {
+		part, err := mbox.generate(ctx, promptDigest, promptData{Summaries: batch, Part: i + 1, Parts: len(batches)}, nil)
+		if err != nil {
+			return "", fmt.Errorf("batch %d of %d: %v", i+1, len(batches), err)
+		}
+		parts[i] = strings.TrimSpace(part)
+	}
+	// Briefings that still don't fit are combined in rounds, as long as that
+	// makes them fewer.
+	truncated := false
+	for ai.tokens(joinParts(parts)) > budget {
+		groups := packTexts(parts, "\n\n", budget, ai.tokens)
+		if len(groups) >= len(parts) {
+			break
+		}
+		for i, group := range groups {
+			if groups[i], err = mbox.generate(ctx, promptDigest, promptData{Message: group, Chunked: true}, nil); err != nil {
+				return "", err
+			}
+			groups[i] = strings.TrimSpace(groups[i])
+		}
+		parts = groups
+	}
+	combined := joinParts(parts)
+	if ai.tokens(combined) > budget {
+		combined = cutTokens(combined, budget, ai.tokens)
+		truncated = true
+	}
+	briefing, err := mbox.generate(ctx, promptDigest, promptData{Message: combined, Chunked: true}, nil)
+	if err != nil {
+		return "", err
+	}
+	if truncated {
+		log.Printf("Digest of %d messages is too long for %s, left out the least important ones", len(entries), ai.name())
+		briefing += "\n\n*There were too many messages to brief them all, the least important ones were left out.*"
+	}
+	return briefing, nil
+}
+
+// digestBatches splits the entries into batches that fit into budget tokens
+// of the digest prompt. An entry over the budget makes up a batch of its own.
+func (mbox *mailBox) digestBatches(ai LLM, entries []promptEntry, budget int) ([][]promptEntry, error) {
+	// The size of an entry is what it adds to the prompt.
+	_, empty, err := mbox.render(promptDigest, promptData{})
+	if err != nil {
+		return nil, err
+	}
+	batches := [][]promptEntry{}
+	var batch []promptEntry
+	n := 0
+	for _, e := range entries {
+		_, prompt, err := mbox.render(promptDigest, promptData{Summaries: []promptEntry{e}})
+		if err != nil {
+			return nil, err
+		}
+		size := ai.tokens(prompt) - ai.tokens(empty)
+		if len(batch) > 0 && n+size > budget {
+			batches = append(batches, batch)
+			batch, n = nil, 0
+		}
+		batch = append(batch, e)
+		n += size
+	}
+	return append(batches, batch), nil
+}
+
+// digestSchedule generates a digest at a time of day on some weekdays.
+type digestSchedule struct {
+	// Period is either "daily" or "weekly".
+	Period string `json:"period"`
+	// At is the local time of day, like "08:00".
+	At string `json:"at"`
+	// Days are the weekdays ("mon", "tue", ...) to generate the digest on.
+	// Daily digests default to every day and weekly ones to monday.
+	Days []string `json:"days"`
+
+	hour, minute int
+	days         map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (s *digestSchedule) compile() error {
+	if _, _, err := digestRange(s.Period, time.Now()); err != nil {
+		return err
+	}
+	at, err := time.Parse("15:04", s.At)
+	if err != nil {
+		return fmt.Errorf("%s digest: invalid time %q, want HH:MM", s.Period, s.At)
+	}
+	s.hour, s.minute = at.Hour(), at.Minute()
+
+	s.days = make(map[time.Weekday]bool)
+	for _, day := range s.Days {
+		wd, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+		if !ok {
+			return fmt.Errorf("%s digest: invalid day %q", s.Period, day)
+		}
+		s.days[wd] = true
+	}
+	if len(s.days) == 0 {
+		if s.Period == digestWeekly {
+			s.days[time.Monday] = true
+		} else {
+			for _, wd := range weekdays {
+				s.days[wd] = true
+			}
+		}
+	}
+	return nil
+}
+
+// next returns the first time after t the digest is due.
+func (s *digestSchedule) next(t time.Time) time.Time {
+	for i := 0; ; i++ {
+		due := time.Date(t.Year(), t.Month(), t.Day()+i, s.hour, s.minute, 0, 0, t.Location())
+		if due.After(t) && s.days[due.Weekday()] {
+			return due
+		}
+	}
+}
+
+// digester generates digests on demand and on schedule, and remembers the
+// latest digest of every period.
+type digester struct {
+	mbox  *mailBox
+	store *sqliteDB
+
+	mu     sync.Mutex
+	latest map[string]*digest
+}
+
+func newDigester(mbox *mailBox, store *sqliteDB) *digester {
+	return &digester{
+		mbox:   mbox,
+		store:  store,
+		latest: make(map[string]*digest),
+	}
+}
+
+// generate generates a new digest of the period.
+func (dg *digester) generate(ctx context.Context, period string) (*digest, error) {
+	d, err := generateDigest(ctx, dg.mbox, dg.store, period, time.Now())
+	if err != nil {
+		digestsGenerated.WithLabelValues(period, "error").Inc()
+		return nil, err
+	}
+	digestsGenerated.WithLabelValues(period, "ok").Inc()
+	dg.mu.Lock()
+	dg.latest[period] = d
+	dg.mu.Unlock()
+	return d, nil
+}
+
+// last returns the latest digest of the period, or nil if none was
+// generated yet.
+func (dg *digester) last(period string) *digest {
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+	return dg.latest[period]
+}
+
+// schedule generates the scheduled digests and passes them to deliver, until
+// ctx is cancelled.
+func (dg *digester) schedule(ctx context.Context, schedules []digestSchedule, deliver func(d *digest)) {
+	var wg sync.WaitGroup
+	for i := range schedules {
+		s := &schedules[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				wait := time.Until(s.next(time.Now()))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				d, err := dg.generate(ctx, s.Period)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Could not generate %s digest: %v", s.Period, err)
+					}
+					continue
+				}
+				deliver(d)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDigestBriefing(t *testing.T) {
+	prompts, err := loadPrompts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := strings.Repeat("word ", 100)
+
+	tests := []struct {
+		name     string
+		entries  int
+		size     int
+		requests int
+	}{
+		{"fits", 5, 2000, 1},
+		// 13 entries fit into a batch.
+		{"batched", 20, 2000, 2 + 1},
+		// Only 2 entries fit into a batch.
+		{"small context", 8, 500, 4 + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ai := &partsLLM{size: tt.size}
+			mbox := newMailbox("test", nil, ai, prompts, nil, "")
+			entries := []promptEntry{}
+			for i := 0; i < tt.entries; i++ {
+				entries = append(entries, promptEntry{Sender: fmt.Sprintf("sender%d", i), Subject: "Hi", Priority: "low", Summary: summary})
+			}
+			got, err := mbox.briefing(context.Background(), entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ai.prompts) != tt.requests {
+				t.Errorf("got %d requests, want %d", len(ai.prompts), tt.requests)
+			}
+			for i, prompt := range ai.prompts {
+				if n := countWords(prompt); n > tt.size-min(tt.size/4, maxResponseTokens) {
+					t.Errorf("request %d has %d tokens, over the context of %d", i+1, n, tt.size)
+				}
+			}
+			if got != "final" {
+				t.Errorf("briefing() = %q", got)
+			}
+			if tt.requests > 1 {
+				final := ai.prompts[len(ai.prompts)-1]
+				if !strings.Contains(final, "Part 1:\nfinal") || strings.Contains(final, "word") {
+					t.Errorf("final prompt doesn't combine the batches: %q", final)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var inboxReplies = []scriptedReply{
+	{match: "approved the staging part", reply: "- Bob approved the staging part of the budget.\n- Action: approve the rest (high)"},
+	{match: "approve the Q3 infrastructure budget", reply: "- Alice asks to approve the Q3 budget by Friday (med)"},
+	{match: "primary database", reply: "- The primary database is down, ops are failing over (high)"},
+}
+
+func TestRunOnce(t *testing.T) {
+	h := newHarness(t, "testdata/inbox", inboxReplies)
+	client := h.connect(t)
+
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newsletter isn't summarized and the duplicate of the outage is
+	// dropped, so only three messages reach the LLM.
+	calls := h.llm.calls()
+	if len(calls) != 3 {
+		t.Fatalf("got %d llm requests, want 3: %q", len(calls), calls)
+	}
+	// Messages with the same subject are one conversation.
+	for _, prompt := range calls {
+		if strings.Contains(prompt, "approved the staging part") &&
+			!strings.Contains(prompt, "Alice Smith <alice@example.com>, Bob Jones <bob@example.com>") {
+			t.Errorf("prompt of the reply doesn't list the participants of the conversation: %q", prompt)
+		}
+	}
+
+	pushed := client.readUntil(webNewsletters)
+	started := []string{}
+	completed := map[string]webMsg{}
+	deltas := map[string]string{}
+	for _, msg := range pushed {
+		switch msg.Type {
+		case webSummaryStarted:
+			started = append(started, msg.ID)
+		case webSummaryDelta:
+			deltas[msg.ID] += msg.Delta
+		case webSummaryCompleted:
+			completed[msg.ID] = msg
+		}
+	}
+	ids := []string{"<budget-1@example.com>", "<budget-2@example.com>", "<outage@example.com>"}
+	sort.Strings(started)
+	if !reflect.DeepEqual(started, ids) {
+		t.Errorf("started %q, want %q", started, ids)
+	}
+	if before(pushed, webSummaryCompleted, "<budget-2@example.com>", "<budget-1@example.com>") {
+		t.Error("the reply was pushed before the message it replies to")
+	}
+	for _, id := range ids {
+		summary := h.summaryOf(t, id)
+		if deltas[id] != summary {
+			t.Errorf("deltas of %s = %q, want %q", id, deltas[id], summary)
+		}
+		msg, ok := completed[id]
+		if !ok {
+			t.Errorf("%s wasn't pushed", id)
+			continue
+		}
+		if !strings.Contains(msg.Message, `<span class="priority-`) {
+			t.Errorf("priority of %s isn't highlighted: %q", id, msg.Message)
+		}
+	}
+	if msg := completed["<outage@example.com>"]; !strings.Contains(msg.Original, "primary database") {
+		t.Errorf("original of the outage = %q", msg.Original)
+	}
+	// The summaries have no classification, so their qualifier decides.
+	if msg := completed["<outage@example.com>"]; msg.Priority != "high" || msg.Score != 2*2*scoreLevel {
+		t.Errorf("outage pushed with priority %q and score %d", msg.Priority, msg.Score)
+	}
+	if m, err := h.store.findMessage("<budget-1@example.com>"); err != nil || m.Priority != "med" || m.Score != 2*scoreLevel {
+		t.Errorf("budget stored as %+v (%v)", m, err)
+	}
+
+	got := h.notifier.notifications()
+	sort.Strings(got)
+	want := []string{"Production outage", "Q3 budget", "Q3 budget"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications %q, want %q", got, want)
+	}
+
+	// The next cycle fetches the same messages, which were all stored.
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.llm.calls()); n != 3 {
+		t.Errorf("got %d llm requests after the second cycle, want 3", n)
+	}
+	if n := len(h.notifier.notifications()); n != 3 {
+		t.Errorf("got %d notifications after the second cycle, want 3", n)
+	}
+	// Anything pushed in the second cycle would arrive before the marker.
+	h.web.pushAuthRequired()
+	if pushed := client.readUntil(webAuthRequired); len(pushed) != 1 {
+		t.Errorf("second cycle pushed %v", pushed[:len(pushed)-1])
+	}
+}
+
+func TestRunOnceStoresNewsletters(t *testing.T) {
+	h := newHarness(t, "testdata/inbox", inboxReplies)
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m, err := h.store.findMessage("<news-23@newsletter.example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Bulk || m.Summary != "" || m.Unsubscribe != "https://newsletter.example.com/unsubscribe?id=23" {
+		t.Errorf("newsletter stored as %+v", m)
+	}
+	if !reflect.DeepEqual(m.Tags, []string{"newsletter"}) {
+		t.Errorf("newsletter tags = %q", m.Tags)
+	}
+}
+
+// summaryOf returns the stored summary of the message.
+func (h *harness) summaryOf(t *testing.T, id string) string {
+	t.Helper()
+	m, err := h.store.findMessage(id)
+	if err != nil {
+		t.Fatalf("%s: %v", id, err)
+	}
+	return m.Summary
+}
+
+// before reports whether the message of type typ for id a was pushed before
+// the one for b.
+func before(msgs []webMsg, typ, a, b string) bool {
+	for _, msg := range msgs {
+		if msg.Type != typ {
+			continue
+		}
+		switch msg.ID {
+		case a:
+			return true
+		case b:
+			return false
+		}
+	}
+	return false
+}
+
+func TestRunOnceMailsAlerts(t *testing.T) {
+	h := newHarness(t, "testdata/inbox", inboxReplies)
+	sink := newSMTPSink(t, nil, false)
+	mailer, err := newSMTPSender(smtpConfig{
+		Host:   "127.0.0.1",
+		Port:   sink.port(),
+		TLS:    "none",
+		From:   "mailassist@example.com",
+		To:     []string{"me@example.com"},
+		Alerts: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.app.mailer = mailer
+
+	var subjects []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range sink.received {
+			for _, line := range strings.Split(m.data, "\r\n") {
+				if strings.HasPrefix(line, "Subject: ") {
+					subjects = append(subjects, strings.TrimPrefix(line, "Subject: "))
+				}
+			}
+		}
+	}()
+	// The cycle only ends once the alerts are sent.
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(sink.received)
+	<-done
+	sort.Strings(subjects)
+	want := []string{"[high] Production outage", "[high] Q3 budget"}
+	if !reflect.DeepEqual(subjects, want) {
+		t.Errorf("mailed alerts %q, want %q", subjects, want)
+	}
+}
+
+func TestRunOnceRetriesFailedSummaries(t *testing.T) {
+	replies := append([]scriptedReply{}, inboxReplies...)
+	replies[2].failures = 1
+	h := newHarness(t, "testdata/inbox", replies)
+	client := h.connect(t)
+
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pushed := client.readUntil(webNewsletters)
+	var failed bool
+	for _, msg := range pushed {
+		if msg.ID != "<outage@example.com>" {
+			continue
+		}
+		switch msg.Type {
+		case webSummaryFailed:
+			failed = msg.Delta == errScripted.Error()
+		case webSummaryCompleted:
+			t.Errorf("failed summary was pushed: %q", msg.Message)
+		}
+	}
+	if !failed {
+		t.Error("failure of the outage wasn't pushed")
+	}
+	if _, err := h.store.findMessage("<outage@example.com>"); err == nil {
+		t.Error("message with a failed summary was stored")
+	}
+	for _, n := range h.notifier.notifications() {
+		if n == "Production outage" {
+			t.Error("message with a failed summary was notified")
+		}
+	}
+
+	// The next cycle only summarizes the failed message again.
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.llm.calls()); n != 4 {
+		t.Errorf("got %d llm requests after the second cycle, want 4", n)
+	}
+	if summary := h.summaryOf(t, "<outage@example.com>"); summary != replies[2].reply {
+		t.Errorf("summary of the outage = %q", summary)
+	}
+}
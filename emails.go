@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/html"
 )
@@ -13,7 +16,24 @@ type mailBox struct {
 	ai            LLM
 	provider      mailProvider
 	name          string
+	bio           string
+	prompts       *promptSet
+	cache         *sqliteDB
 	conversations []*mailConversation
+
+	// rules are evaluated for every message, and llms are the backends they
+	// can route messages to.
+	rules []rule
+	llms  map[string]LLM
+	// usage records the tokens used by every request, unless it's nil.
+	usage *usageTracker
+	// scorer scores the priority of summarized messages.
+	scorer *priorityScorer
+
+	mu sync.Mutex
+	// recentCorrections are the examples the prompts show the LLM, see
+	// loadCorrections.
+	recentCorrections []promptCorrection
 }
 
 type mailConversation struct {
@@ -24,24 +44,101 @@ type mailConversation struct {
 
 type mailMessage struct {
 	conversation *mailConversation
-	from         string
-	date         string
-	msg          string
+	// providerID is the ID the provider uses for the message and messageID
+	// its RFC 5322 Message-ID. Either can be empty.
+	providerID string
+	messageID  string
+	// threadID is the provider's ID for the thread of the message.
+	threadID string
+	from     string
+	date     string
+	msg      string
+	header   map[string]string
+	// actions are the combined actions of the rules matching the message.
+	actions ruleActions
+	// bulk is set for newsletters and other bulk mail, which is collected
+	// for the newsletter digest instead of being summarized.
+	bulk *bulkInfo
+	// priority is scored once the message is summarized.
+	priority priorityScore
 }
 
-func newMailbox(provider mailProvider, ai LLM) *mailBox {
-	return &mailBox{
+// newMailbox creates a mailbox for the account name. Summaries are cached in
+// cache, unless it's nil.
+func newMailbox(name string, provider mailProvider, ai LLM, prompts *promptSet, cache *sqliteDB, bio string) *mailBox {
+	mbox := &mailBox{
 		ai:       ai,
 		provider: provider,
+		name:     name,
+		bio:      bio,
+		prompts:  prompts,
+		cache:    cache,
+	}
+	if cache != nil {
+		mbox.loadCorrections()
+		// Rules can choose any template for summaries, so all of them are
+		// pruned.
+		for name, t := range prompts.templates {
+			if err := cache.pruneSummaries(name, t.version); err != nil {
+				log.Printf("Could not prune summary cache: %v", err)
+			}
+		}
+	}
+	return mbox
+}
+
+// promptVersion changes whenever anything that goes into the prompt of task,
+// other than the message itself, changes.
+func (mbox *mailBox) promptVersion(task string) (string, error) {
+	t, err := mbox.prompts.get(task)
+	if err != nil {
+		return "", err
 	}
+	return t.version + "-" + hashString(mbox.bio + "\x00" + mbox.name)[:8], nil
 }
 
-func (mbox *mailBox) fetch() error {
-	msgs, err := mbox.provider.fetch()
+// render renders the prompt template of task for a message of the mailbox.
+func (mbox *mailBox) render(task string, data promptData) (string, string, error) {
+	t, err := mbox.prompts.get(task)
 	if err != nil {
-		return err
+		return "", "", err
+	}
+	data.Bio = mbox.bio
+	data.Account = mbox.name
+	data.Corrections = mbox.corrections()
+	return t.render(data)
+}
+
+// generate renders the prompt template of task and sends it to the LLM.
+func (mbox *mailBox) generate(ctx context.Context, task string, data promptData, delta func(string)) (string, error) {
+	return mbox.generateWith(ctx, mbox.ai, task, data, delta)
+}
+
+// generateWith works like generate, but sends the prompt to ai.
+func (mbox *mailBox) generateWith(ctx context.Context, ai LLM, task string, data promptData, delta func(string)) (string, error) {
+	system, prompt, err := mbox.render(task, data)
+	if err != nil {
+		return "", err
+	}
+	ctx, usage := withUsage(ctx)
+	out, err := ai.generate(ctx, system, prompt, delta)
+	if mbox.usage != nil && usage.backend != "" {
+		if err := mbox.usage.record(mbox.name, task, usage, time.Now()); err != nil {
+			log.Printf("Could not record llm usage: %v", err)
+		}
 	}
+	return out, err
+}
+
+// fetch retrieves new messages from the provider.
+func (mbox *mailBox) fetch(ctx context.Context) ([]providerMessage, error) {
+	return mbox.provider.fetch(ctx)
+}
 
+// parse decodes the fetched messages and groups them into conversations,
+// which replace the conversations of the previous cycle.
+func (mbox *mailBox) parse(msgs []providerMessage) []*mailConversation {
+	mbox.conversations = nil
 	conversations := make(map[string][]*providerMessage)
 	for i := range msgs {
 		subject := msgs[i].header["Subject"]
@@ -58,33 +155,40 @@ func (mbox *mailBox) fetch() error {
 		for i := range v {
 			//strBody := decode(v[i].message)
 			s, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(v[i].message))
-			strBody := stripHTML(string(s))
+			strBody, err := stripHTML(string(s))
+			if err != nil {
+				log.Printf("Skipping message from %q: %v", v[i].header["From"], err)
+				continue
+			}
 			if len(strBody) == 0 {
 				continue
 			}
+			actions := evaluateRules(mbox.rules, v[i].header, strBody)
+			if actions.Skip {
+				messagesSkipped.WithLabelValues("rule").Inc()
+				continue
+			}
 			//strBody := parseMessage(string(v[i].message))
 			msg := mailMessage{
 				conversation: c,
+				providerID:   v[i].id,
+				messageID:    v[i].messageID(),
+				threadID:     v[i].threadID,
 				from:         v[i].header["From"],
 				msg:          strBody,
 				date:         v[i].header["Date"],
+				header:       v[i].header,
+				actions:      actions,
+				bulk:         actions.bulk(detectBulk(v[i].header)),
+			}
+			if msg.bulk != nil && !contains(msg.actions.Tags, "newsletter") {
+				msg.actions.Tags = append(msg.actions.Tags, "newsletter")
 			}
 			c.messages = append(c.messages, msg)
 		}
 		mbox.conversations = append(mbox.conversations, c)
 	}
-	/*
-
-		if strings.Contains(sender, "calendar-notification@google.com") || strings.Contains(sender, "asana.com") || strings.Contains(sender, "mailer-daemon@googlemail.com") || strings.Contains(sender, "futurevisions.atlassian.net") {
-			continue
-		}
-
-		if strings.Contains(from, "calendar-notification@google.com") || strings.Contains(from, "asana.com") || strings.Contains(from, "mailer-daemon@googlemail.com") || strings.Contains(from, "futurevisions.atlassian.net") {
-			continue
-		}
-
-	*/
-	return nil
+	return mbox.conversations
 }
 
 func extractTextPart(part string) string {
@@ -139,31 +243,123 @@ func parseMessage(rawEmail string) string {
 	return parsed
 }
 
-func (mbox *mailBox) summarize(cb func(from string, date string, subject string, message string, original string)) {
-	for i := range mbox.conversations {
-		for j := range mbox.conversations[i].messages {
-			msg := mbox.conversations[i].messages[j]
-			summary := msg.summary()
-			cb(msg.from, msg.date, mbox.conversations[i].subject, summary, msg.msg)
-		}
+// id identifies the message across polling cycles. The Message-ID is
+// preferred, since it's the same across providers, followed by the provider's
+// ID. Only messages with neither fall back to a hash of the headers.
+func (m *mailMessage) id() string {
+	switch {
+	case m.messageID != "":
+		return m.messageID
+	case m.providerID != "":
+		return m.providerID
 	}
+	return hashMail(m.date, m.from, m.conversation.subject)
 }
 
 func (m *mailMessage) removeHistory() *mailMessage {
 	return nil
 }
 
-func (m *mailMessage) summary() string {
-	ai := m.conversation.mailbox.ai
-	msg, err := ai.summary(m.msg)
+// promptData returns the template variables describing the message.
+func (m *mailMessage) promptData() promptData {
+	participants := []string{}
+	for _, other := range m.conversation.messages {
+		if !contains(participants, other.from) {
+			participants = append(participants, other.from)
+		}
+	}
+	return promptData{
+		Sender:       m.from,
+		Subject:      m.conversation.subject,
+		Date:         m.date,
+		Participants: participants,
+		Message:      m.msg,
+	}
+}
+
+func (m *mailMessage) summary(ctx context.Context) (string, error) {
+	return m.summaryStream(ctx, nil)
+}
+
+// summaryStream summarizes the message, passing the summary to delta as it's
+// generated. Summaries are served from the cache when the message was
+// already summarized with the same model and prompt.
+func (m *mailMessage) summaryStream(ctx context.Context, delta func(string)) (string, error) {
+	return m.cachedSummary(ctx, delta)
+}
+
+// summarized reports whether the message is summarized and shown on its own.
+func (m *mailMessage) summarized() bool {
+	return !m.actions.SkipLLM && m.bulk == nil
+}
+
+// llm returns the backend that summarizes the message, which rules can
+// change.
+func (m *mailMessage) llm() LLM {
+	mbox := m.conversation.mailbox
+	if ai, ok := mbox.llms[m.actions.LLM]; ok {
+		return ai
+	}
+	return mbox.ai
+}
+
+// summaryPrompt returns the name of the prompt template for the summary,
+// which rules can change.
+func (m *mailMessage) summaryPrompt() string {
+	if m.actions.Prompt != "" {
+		return m.actions.Prompt
+	}
+	return promptSummary
+}
+
+func (m *mailMessage) cachedSummary(ctx context.Context, delta func(string)) (string, error) {
+	mbox := m.conversation.mailbox
+	ai, task := m.llm(), m.summaryPrompt()
+	if mbox.cache == nil {
+		return mbox.generateLong(ctx, ai, task, m.promptData(), delta)
+	}
+
+	version, err := mbox.promptVersion(task)
+	if err != nil {
+		return "", err
+	}
+	system, prompt, err := mbox.render(task, m.promptData())
 	if err != nil {
-		return fmt.Sprintf("(error: %v)", err)
+		return "", err
+	}
+	key := summaryKey(ai.name(), system, prompt)
+	if summary, ok := mbox.cache.cachedSummary(key); ok {
+		if delta != nil {
+			delta(summary)
+		}
+		return summary, nil
 	}
-	return msg
+
+	summary, err := mbox.generateLong(ctx, ai, task, m.promptData(), delta)
+	if err != nil {
+		return "", err
+	}
+	if err := mbox.cache.cacheSummary(&sqlSummary{
+		Key:           key,
+		BodyHash:      hashString(normalizeBody(m.msg)),
+		Model:         ai.name(),
+		Prompt:        task,
+		PromptVersion: version,
+		Summary:       summary,
+	}); err != nil {
+		log.Printf("Could not cache summary: %v", err)
+	}
+	return summary, nil
 }
 
-func (m *mailMessage) actionItems() []string {
-	return nil
+// actionItems asks the LLM for the action items in the message.
+func (m *mailMessage) actionItems(ctx context.Context) ([]string, error) {
+	mbox := m.conversation.mailbox
+	a, err := mbox.generateLong(ctx, mbox.ai, promptActions, m.promptData(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseActionItems(a), nil
 }
 
 func decode(rawEmail string) string {
@@ -212,16 +408,15 @@ func decode(rawEmail string) string {
 }
 
 // stripHTML removes HTML tags and CSS styles and returns plain text
-func stripHTML(htmlContent string) string {
+func stripHTML(htmlContent string) (string, error) {
 	doc, err := html.Parse(strings.NewReader(htmlContent))
 	if err != nil {
-		log.Fatalf("Failed to parse HTML: %v", err)
-		return ""
+		return "", fmt.Errorf("failed to parse HTML: %v", err)
 	}
 	var b strings.Builder
 	traverser := &htmlTraverser{skip: false}
 	traverser.walkNodes(doc, &b)
-	return b.String()
+	return b.String(), nil
 }
 
 type htmlTraverser struct {
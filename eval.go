@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// evalDataset is a set of labeled emails to evaluate summaries against.
+type evalDataset struct {
+	// Bio is the bio the labels were written for. -bio overrides it.
+	Bio   string     `json:"bio"`
+	Cases []evalCase `json:"cases"`
+}
+
+// evalCase is a labeled email.
+type evalCase struct {
+	Name    string `json:"name"`
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+	Date    string `json:"date"`
+	Body    string `json:"body"`
+
+	// Priority is the expected priority of the email: low, med or high.
+	Priority string `json:"priority"`
+	// ActionItems are the action items the user expects, and Facts what the
+	// summary has to mention, in a few words each.
+	ActionItems []string `json:"action_items"`
+	Facts       []string `json:"facts"`
+}
+
+// evalResult is the outcome of a case.
+type evalResult struct {
+	Name        string   `json:"name"`
+	Summary     string   `json:"summary"`
+	ActionItems []string `json:"action_items"`
+	Error       string   `json:"error,omitempty"`
+
+	Priority         string `json:"priority"`
+	ExpectedPriority string `json:"expected_priority"`
+	ActionsFound     int    `json:"actions_found"`
+	ActionsExpected  int    `json:"actions_expected"`
+	FactsFound       int    `json:"facts_found"`
+	FactsExpected    int    `json:"facts_expected"`
+	// Hallucinated are the names and numbers in the summary that aren't in
+	// the email, out of Entities.
+	Hallucinated []string `json:"hallucinated"`
+	Entities     int      `json:"entities"`
+	Words        int      `json:"words"`
+}
+
+// evalReport is the outcome of a run, which can be saved with -out and
+// compared to with -baseline.
+type evalReport struct {
+	Model    string       `json:"model"`
+	Template string       `json:"template"`
+	Version  string       `json:"version"`
+	Dataset  string       `json:"dataset"`
+	Time     time.Time    `json:"time"`
+	Results  []evalResult `json:"results"`
+}
+
+// evalScores are the aggregated scores of a report.
+type evalScores struct {
+	ActionRecall      float64
+	PriorityAccuracy  float64
+	FactRecall        float64
+	HallucinationRate float64
+	Words             float64
+}
+
+func loadEvalDataset(file string) (*evalDataset, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ds evalDataset
+	if err := json.Unmarshal(b, &ds); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for i, c := range ds.Cases {
+		if c.Name == "" || c.Body == "" {
+			return nil, fmt.Errorf("%s: case %d needs a name and a body", file, i+1)
+		}
+		switch c.Priority {
+		case "", "low", "med", "high":
+		default:
+			return nil, fmt.Errorf("%s: case %q: unknown priority %q", file, c.Name, c.Priority)
+		}
+	}
+	return &ds, nil
+}
+
+func loadEvalReport(file string) (*evalReport, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var r evalReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &r, nil
+}
+
+// evaluate summarizes every case with the prompt template and asks for its
+// action items, and scores the results against the labels.
+func evaluate(ctx context.Context, mbox *mailBox, ds *evalDataset, template string, progress io.Writer) []evalResult {
+	results := []evalResult{}
+	for i, c := range ds.Cases {
+		fmt.Fprintf(progress, "[%d/%d] %s\n", i+1, len(ds.Cases), c.Name)
+		data := promptData{
+			Sender:       c.From,
+			Subject:      c.Subject,
+			Date:         c.Date,
+			Participants: []string{c.From},
+			Message:      c.Body,
+		}
+		r := evalResult{Name: c.Name}
+		summary, err := mbox.generateLong(ctx, mbox.ai, template, data, nil)
+		if err == nil {
+			var actions string
+			actions, err = mbox.generateLong(ctx, mbox.ai, promptActions, data, nil)
+			r.ActionItems = parseActionItems(actions)
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Summary = strings.TrimSpace(summary)
+		r.score(c, mbox.bio)
+		results = append(results, r)
+	}
+	return results
+}
+
+// score compares the result to the labels of the case.
+func (r *evalResult) score(c evalCase, bio string) {
+	r.ExpectedPriority = c.Priority
+	// The emails of the dataset are scored without signals about the
+	// sender, which depend on the mailbox.
+	r.Priority = scoreSummary(r.Summary).Level
+	r.ActionsExpected = len(c.ActionItems)
+	for _, want := range c.ActionItems {
+		for _, got := range r.ActionItems {
+			if mentions(got, want) {
+				r.ActionsFound++
+				break
+			}
+		}
+	}
+	r.FactsExpected = len(c.Facts)
+	for _, fact := range c.Facts {
+		if mentions(r.Summary, fact) {
+			r.FactsFound++
+		}
+	}
+	source := strings.ToLower(strings.Join([]string{c.From, c.Subject, c.Date, c.Body, bio}, "\n"))
+	entities := extractEntities(r.Summary)
+	r.Entities = len(entities)
+	r.Hallucinated = []string{}
+	for _, e := range entities {
+		if !strings.Contains(source, strings.ToLower(e)) {
+			r.Hallucinated = append(r.Hallucinated, e)
+		}
+	}
+	r.Words = len(strings.Fields(r.Summary))
+}
+
+// scores aggregates the results. Recall is computed over all expected items,
+// so cases with more labels weigh more.
+func scores(results []evalResult) evalScores {
+	var s evalScores
+	var found, expected, facts, factsExpected, priorities, prioritiesOK, hallucinated, entities int
+	for _, r := range results {
+		found += r.ActionsFound
+		expected += r.ActionsExpected
+		facts += r.FactsFound
+		factsExpected += r.FactsExpected
+		if r.ExpectedPriority != "" {
+			priorities++
+			if r.Priority == r.ExpectedPriority {
+				prioritiesOK++
+			}
+		}
+		hallucinated += len(r.Hallucinated)
+		entities += r.Entities
+		s.Words += float64(r.Words)
+	}
+	s.ActionRecall = ratio(found, expected)
+	s.PriorityAccuracy = ratio(prioritiesOK, priorities)
+	s.FactRecall = ratio(facts, factsExpected)
+	s.HallucinationRate = ratio(hallucinated, entities)
+	if len(results) > 0 {
+		s.Words /= float64(len(results))
+	}
+	return s
+}
+
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// printEvalReport prints the results and scores of the report, and how they
+// changed since the baseline, if it's set.
+func printEvalReport(w io.Writer, r *evalReport, baseline *evalReport) {
+	fmt.Fprintf(w, "%s, %s template version %s, %s\n\n", r.Model, r.Template, r.Version, r.Dataset)
+	fmt.Fprintf(w, "%-24s %-11s %-8s %-6s %-7s %s\n", "case", "priority", "actions", "facts", "halluc", "words")
+	for _, res := range r.Results {
+		fmt.Fprintf(w, "%-24s %-11s %-8s %-6s %-7s %d\n", res.Name,
+			res.ExpectedPriority+"/"+res.Priority,
+			fmt.Sprintf("%d/%d", res.ActionsFound, res.ActionsExpected),
+			fmt.Sprintf("%d/%d", res.FactsFound, res.FactsExpected),
+			fmt.Sprintf("%d/%d", len(res.Hallucinated), res.Entities),
+			res.Words)
+		if res.Error != "" {
+			fmt.Fprintf(w, "    error: %s\n", res.Error)
+		}
+		if len(res.Hallucinated) > 0 {
+			fmt.Fprintf(w, "    not in the email: %s\n", strings.Join(res.Hallucinated, ", "))
+		}
+	}
+
+	s := scores(r.Results)
+	var b evalScores
+	if baseline != nil {
+		b = scores(baseline.Results)
+		fmt.Fprintf(w, "\ncompared to %s, %s template version %s\n", baseline.Model, baseline.Template, baseline.Version)
+	}
+	fmt.Fprintln(w)
+	for _, m := range []struct {
+		name           string
+		value, base    float64
+		percent, lower bool
+	}{
+		{"action-item recall", s.ActionRecall, b.ActionRecall, true, false},
+		{"priority accuracy", s.PriorityAccuracy, b.PriorityAccuracy, true, false},
+		{"fact recall", s.FactRecall, b.FactRecall, true, false},
+		{"hallucinated entities", s.HallucinationRate, b.HallucinationRate, true, true},
+		{"average length (words)", s.Words, b.Words, false, true},
+	} {
+		value := fmt.Sprintf("%.1f", m.value)
+		if m.percent {
+			value = fmt.Sprintf("%.0f%%", 100*m.value)
+		}
+		if baseline == nil {
+			fmt.Fprintf(w, "%-24s %8s\n", m.name, value)
+			continue
+		}
+		d := m.value - m.base
+		change := fmt.Sprintf("%+.1f", d)
+		if m.percent {
+			change = fmt.Sprintf("%+.0f%%", 100*d)
+		}
+		verdict := ""
+		if d != 0 && (d < 0) == m.lower {
+			verdict = " better"
+		} else if d != 0 {
+			verdict = " worse"
+		}
+		fmt.Fprintf(w, "%-24s %8s %8s%s\n", m.name, value, change, verdict)
+	}
+
+	if baseline != nil {
+		diffEvalResults(w, r.Results, baseline.Results)
+	}
+}
+
+// diffEvalResults prints the cases whose scores changed since the baseline.
+func diffEvalResults(w io.Writer, results, baseline []evalResult) {
+	before := make(map[string]evalResult)
+	for _, r := range baseline {
+		before[r.Name] = r
+	}
+	header := false
+	for _, r := range results {
+		b, ok := before[r.Name]
+		if !ok {
+			continue
+		}
+		changes := []string{}
+		if r.Priority != b.Priority {
+			changes = append(changes, fmt.Sprintf("priority %s → %s", b.Priority, r.Priority))
+		}
+		if r.ActionsFound != b.ActionsFound {
+			changes = append(changes, fmt.Sprintf("actions %d → %d of %d", b.ActionsFound, r.ActionsFound, r.ActionsExpected))
+		}
+		if r.FactsFound != b.FactsFound {
+			changes = append(changes, fmt.Sprintf("facts %d → %d of %d", b.FactsFound, r.FactsFound, r.FactsExpected))
+		}
+		if len(r.Hallucinated) != len(b.Hallucinated) {
+			changes = append(changes, fmt.Sprintf("hallucinated %d → %d", len(b.Hallucinated), len(r.Hallucinated)))
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(w, "\nchanged cases:")
+			header = true
+		}
+		fmt.Fprintf(w, "  %-22s %s\n", r.Name, strings.Join(changes, ", "))
+	}
+}
+
+// parseActionItems returns the items of the bullet list in the response of
+// the actions prompt.
+func parseActionItems(text string) []string {
+	items := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
+			items = append(items, strings.TrimSpace(line[2:]))
+		}
+	}
+	return items
+}
+
+// evalStopwords are left out when matching labels against the results.
+var evalStopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "that": true, "this": true,
+	"from": true, "about": true, "into": true, "are": true, "was": true, "has": true,
+	"have": true, "will": true, "its": true, "our": true, "your": true, "their": true,
+	"need": true, "needs": true, "should": true, "must": true, "can": true,
+}
+
+// labelWords returns the lowercased words of a label that carry meaning.
+func labelWords(s string) []string {
+	words := []string{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !evalStopwords[w] && (len(w) > 2 || strings.IndexFunc(w, unicode.IsDigit) >= 0) {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// mentions reports whether text covers the label: at least two thirds of the
+// words of the label appear in text, allowing for different word endings.
+func mentions(text, label string) bool {
+	want := labelWords(label)
+	if len(want) == 0 {
+		return strings.Contains(strings.ToLower(text), strings.ToLower(label))
+	}
+	have := labelWords(text)
+	found := 0
+	for _, w := range want {
+		for _, h := range have {
+			if sameWord(w, h) {
+				found++
+				break
+			}
+		}
+	}
+	return 3*found >= 2*len(want)
+}
+
+// sameWord reports whether a and b are the same word, or differ only in the
+// last letters, like "approve" and "approval".
+func sameWord(a, b string) bool {
+	if a == b {
+		return true
+	}
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n >= max(4, min(len(a), len(b))-1)
+}
+
+// entityWords are capitalized words summaries use without them being names.
+var entityWords = map[string]bool{
+	"i": true, "action": true, "actions": true, "item": true, "items": true,
+	"summary": true, "priority": true, "high": true, "med": true, "medium": true,
+	"low": true, "urgency": true, "importance": true, "urgent": true, "important": true,
+	"none": true, "n/a": true, "re": true, "fwd": true,
+}
+
+// extractEntities returns the words of the summary that look like names,
+// numbers or addresses: capitalized words that don't start a sentence, and
+// words with digits or an @.
+func extractEntities(summary string) []string {
+	entities := []string{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(summary, "\n") {
+		line = strings.TrimLeft(strings.TrimSpace(line), "-*#>0123456789. ")
+		start := true
+		for _, w := range strings.Fields(line) {
+			end := strings.IndexAny(w[len(w)-1:], ".!?:") >= 0
+			w = strings.Trim(w, `.,;:!?()[]{}"'*_$€£`)
+			if w != "" && !seen[w] && !entityWords[strings.ToLower(w)] {
+				r := []rune(w)
+				digits := strings.IndexFunc(w, unicode.IsDigit) >= 0
+				if digits || strings.Contains(w, "@") || (!start && unicode.IsUpper(r[0])) {
+					entities = append(entities, w)
+					seen[w] = true
+				}
+			}
+			start = end
+		}
+	}
+	return entities
+}
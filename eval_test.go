@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		text, label string
+		want        bool
+	}{
+		{"Approve the budget for Q3 by Friday", "approve the Q3 infrastructure budget", true},
+		{"Budget approval is needed", "approve budget", true},
+		{"The total is $48,200.", "$48,200", true},
+		{"Schedule a 1:1 with Marko", "meet Marko this week", false},
+		{"Roughly the same as last quarter", "approve the budget", false},
+		{"Due by the end of June", "end of June", true},
+	}
+	for _, tt := range tests {
+		if got := mentions(tt.text, tt.label); got != tt.want {
+			t.Errorf("mentions(%q, %q) = %v, want %v", tt.text, tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestExtractEntities(t *testing.T) {
+	summary := "- Alice asks to approve the Q3 budget of $48,200 by Friday.\n" +
+		"- Action items: Reply to alice@example.com (high)\n" +
+		"Summary: Bob agreed with Carol. Dave did not."
+	// Words that start a sentence are capitalized anyway.
+	want := []string{"Q3", "48,200", "Friday", "alice@example.com", "Carol"}
+	if got := extractEntities(summary); !reflect.DeepEqual(got, want) {
+		t.Errorf("extractEntities() = %q, want %q", got, want)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	ds, err := loadEvalDataset("eval/golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts, err := loadPrompts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Cases = ds.Cases[:1]
+	ai := &scriptedLLM{replies: []scriptedReply{
+		{match: "List the action items", reply: "- Approve the Q3 infrastructure budget (high)"},
+		{match: "Create a short summary", reply: "- Alice needs the Q3 budget of $48,200 approved by Friday, Bob from Finance agrees (high)"},
+	}}
+	mbox := newMailbox("test", nil, ai, prompts, nil, ds.Bio)
+	results := evaluate(context.Background(), mbox, ds, promptSummary, io.Discard)
+
+	r := results[0]
+	if r.Priority != "high" || r.ActionsFound != 1 || r.FactsFound != 2 || r.FactsExpected != 4 {
+		t.Errorf("scored %+v", r)
+	}
+	if !reflect.DeepEqual(r.Hallucinated, []string{"Bob"}) {
+		t.Errorf("hallucinated %q", r.Hallucinated)
+	}
+
+	baseline := &evalReport{Model: "old", Results: []evalResult{r}}
+	baseline.Results[0].Priority = "med"
+	var out bytes.Buffer
+	printEvalReport(&out, &evalReport{Model: "scripted", Results: results}, baseline)
+	for _, want := range []string{"priority accuracy", "+100% better", "priority med → high"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of feedback on a summary.
+const (
+	// feedbackUp and feedbackDown rate the summary as a whole. A message has
+	// at most one rating, the latest one.
+	feedbackUp   = "up"
+	feedbackDown = "down"
+	// feedbackPriority corrects the priority of the summary.
+	feedbackPriority = "priority"
+	// feedbackMissedAction adds an action item the summary missed.
+	feedbackMissedAction = "missed_action"
+)
+
+// maxCorrections is how many of the latest corrections are added to the
+// prompts as examples.
+const maxCorrections = 5
+
+// sqlFeedback is the feedback of the user on the summary of a stored message.
+type sqlFeedback struct {
+	ID        uint
+	CreatedAt time.Time `gorm:"index"`
+	Account   string    `gorm:"index"`
+	// MessageID is the ID of the sqlMessage.
+	MessageID uint `gorm:"index"`
+	Kind      string
+
+	// Model and PromptVersion made the summary.
+	Model         string
+	PromptVersion string
+
+	// Priority is the right priority and Was the priority of the summary,
+	// for priority corrections.
+	Priority string
+	Was      string
+	// ActionItem is the action item the summary missed.
+	ActionItem string `gorm:"serializer:encrypted"`
+}
+
+// newFeedback returns feedback of the kind on the summary of m.
+func newFeedback(account string, m *sqlMessage, kind string) *sqlFeedback {
+	return &sqlFeedback{
+		Account:       account,
+		MessageID:     m.ID,
+		Kind:          kind,
+		Model:         m.Model,
+		PromptVersion: m.PromptVersion,
+	}
+}
+
+// addFeedback stores the feedback. A rating replaces the earlier rating of
+// the message.
+func (db *sqliteDB) addFeedback(f *sqlFeedback) error {
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		if f.Kind == feedbackUp || f.Kind == feedbackDown {
+			if err := tx.Where("message_id = ? AND kind IN ?", f.MessageID, []string{feedbackUp, feedbackDown}).
+				Delete(&sqlFeedback{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(f).Error
+	})
+}
+
+// recentCorrections returns the latest corrections the user of the account
+// made, newest first.
+func (db *sqliteDB) recentCorrections(account string, n int) ([]promptCorrection, error) {
+	var feedback []sqlFeedback
+	if err := db.db.Where("account = ? AND kind IN ?", account, []string{feedbackPriority, feedbackMissedAction}).
+		Order("id DESC").Limit(n).Find(&feedback).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(feedback))
+	for i, f := range feedback {
+		ids[i] = f.MessageID
+	}
+	var msgs []sqlMessage
+	if len(ids) > 0 {
+		if err := db.db.Select("id", "from", "subject").Find(&msgs, ids).Error; err != nil {
+			return nil, err
+		}
+	}
+	byID := make(map[uint]*sqlMessage, len(msgs))
+	for i := range msgs {
+		byID[msgs[i].ID] = &msgs[i]
+	}
+	corrections := []promptCorrection{}
+	for _, f := range feedback {
+		m, ok := byID[f.MessageID]
+		if !ok {
+			// The message was removed, and the correction with it.
+			continue
+		}
+		corrections = append(corrections, promptCorrection{
+			Sender:     m.From,
+			Subject:    m.Subject,
+			Priority:   f.Priority,
+			Was:        f.Was,
+			ActionItem: f.ActionItem,
+		})
+	}
+	return corrections, nil
+}
+
+// loadCorrections reads the latest corrections of the user, which the prompts
+// show the LLM as examples. They're loaded once per cycle rather than for
+// every request, and only kept with a cache.
+func (mbox *mailBox) loadCorrections() {
+	if mbox.cache == nil {
+		return
+	}
+	corrections, err := mbox.cache.recentCorrections(mbox.name, maxCorrections)
+	if err != nil {
+		log.Printf("Could not read corrections: %v", err)
+		return
+	}
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+	mbox.recentCorrections = corrections
+}
+
+// corrections returns the corrections read by loadCorrections.
+func (mbox *mailBox) corrections() []promptCorrection {
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+	return mbox.recentCorrections
+}
+
+// exportFeedback turns the feedback of the account into a dataset for the
+// eval command. The expected priority of a message is the corrected one or,
+// when the user rated the summary up, the scored one, and its expected
+// action items are those the summary missed. Messages without either are
+// left out, and counted in skipped.
+func (db *sqliteDB) exportFeedback(account, bio string) (ds *evalDataset, skipped int, err error) {
+	var feedback []sqlFeedback
+	if err := db.db.Where("account = ?", account).Order("id").Find(&feedback).Error; err != nil {
+		return nil, 0, err
+	}
+	byMessage := make(map[uint][]sqlFeedback)
+	order := []uint{}
+	for _, f := range feedback {
+		if _, ok := byMessage[f.MessageID]; !ok {
+			order = append(order, f.MessageID)
+		}
+		byMessage[f.MessageID] = append(byMessage[f.MessageID], f)
+	}
+
+	ds = &evalDataset{Bio: bio, Cases: []evalCase{}}
+	for _, id := range order {
+		m, err := db.getMessage(id)
+		if err != nil {
+			skipped++
+			continue
+		}
+		c := evalCase{
+			Name:        fmt.Sprintf("message-%d", m.ID),
+			From:        m.From,
+			Subject:     m.Subject,
+			Date:        m.Date.Format(time.RFC1123Z),
+			Body:        m.Original,
+			ActionItems: []string{},
+			Facts:       []string{},
+		}
+		rating := ""
+		for _, f := range byMessage[id] {
+			switch f.Kind {
+			case feedbackUp, feedbackDown:
+				rating = f.Kind
+			case feedbackPriority:
+				c.Priority = f.Priority
+			case feedbackMissedAction:
+				c.ActionItems = append(c.ActionItems, f.ActionItem)
+			}
+		}
+		if c.Priority == "" && rating == feedbackUp {
+			c.Priority = m.Priority
+		}
+		if c.Priority == "" && len(c.ActionItems) == 0 {
+			skipped++
+			continue
+		}
+		ds.Cases = append(ds.Cases, c)
+	}
+	return ds, skipped, nil
+}
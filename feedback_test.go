@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFeedback(t *testing.T) {
+	h := newHarness(t, "testdata/inbox", inboxReplies)
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	budget, err := h.store.findMessage("<budget-1@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outage, err := h.store.findMessage("<outage@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := h.store.findMessage("<budget-2@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.Model != "scripted" || budget.PromptVersion == "" {
+		t.Errorf("summary stored with model %q and prompt version %q", budget.Model, budget.PromptVersion)
+	}
+
+	priority := newFeedback("test", budget, feedbackPriority)
+	priority.Priority, priority.Was = "high", budget.Priority
+	missed := newFeedback("test", budget, feedbackMissedAction)
+	missed.ActionItem = "tell finance about the budget"
+	for _, f := range []*sqlFeedback{
+		newFeedback("test", budget, feedbackDown),
+		priority,
+		missed,
+		newFeedback("test", outage, feedbackDown),
+		newFeedback("test", outage, feedbackUp),
+		newFeedback("test", reply, feedbackDown),
+		newFeedback("other", outage, feedbackPriority),
+	} {
+		if err := h.store.addFeedback(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ratings int64
+	h.store.db.Model(&sqlFeedback{}).Where("message_id = ? AND kind IN ?", outage.ID, []string{feedbackUp, feedbackDown}).Count(&ratings)
+	if ratings != 1 {
+		t.Errorf("outage has %d ratings, want 1", ratings)
+	}
+
+	// The corrections are only read once per cycle.
+	if corrections := h.app.mbox.corrections(); len(corrections) != 0 {
+		t.Errorf("corrections before the next cycle = %+v", corrections)
+	}
+	h.app.mbox.loadCorrections()
+	corrections := h.app.mbox.corrections()
+	want := []promptCorrection{
+		{Sender: budget.From, Subject: budget.Subject, ActionItem: "tell finance about the budget"},
+		{Sender: budget.From, Subject: budget.Subject, Priority: "high", Was: "med"},
+	}
+	if !reflect.DeepEqual(corrections, want) {
+		t.Errorf("corrections = %+v, want %+v", corrections, want)
+	}
+
+	// The corrections are examples in the prompts, which are redacted for
+	// cloud backends, unlike the system prompts.
+	for task, example := range map[string]string{
+		promptSummary: `"Q3 budget": the priority is 'high', not 'med'.`,
+		promptActions: `You missed the action item "tell finance about the budget"`,
+	} {
+		tmpl, err := h.app.mbox.prompts.get(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, prompt, err := tmpl.render(promptData{Corrections: corrections})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(prompt, example) {
+			t.Errorf("%s prompt doesn't contain %q:\n%s", task, example, prompt)
+		}
+	}
+
+	ds, skipped, err := h.store.exportFeedback("test", "I run the infrastructure team.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reply was only rated down, so there is nothing to expect of it.
+	if skipped != 1 || len(ds.Cases) != 2 {
+		t.Fatalf("exported %d cases, skipped %d", len(ds.Cases), skipped)
+	}
+	if c := ds.Cases[0]; c.Body != budget.Original || c.Priority != "high" ||
+		!reflect.DeepEqual(c.ActionItems, []string{"tell finance about the budget"}) {
+		t.Errorf("budget exported as %+v", c)
+	}
+	// Rating the summary up confirms its priority.
+	if c := ds.Cases[1]; c.Priority != "high" || len(c.ActionItems) != 0 {
+		t.Errorf("outage exported as %+v", c)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeProvider serves the .eml files of a directory, in the order of their
+// names. Like a provider that keeps returning the unread messages, every
+// fetch returns all of them.
+type fakeProvider struct {
+	msgs []providerMessage
+
+	mu      sync.Mutex
+	fetches int
+}
+
+func newFakeProvider(t *testing.T, dir string) *fakeProvider {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	p := &fakeProvider{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := mail.ReadMessage(f)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		body, err := io.ReadAll(m.Body)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		header := make(map[string]string)
+		for k, v := range m.Header {
+			header[k] = v[0]
+		}
+		p.msgs = append(p.msgs, providerMessage{
+			id:     strings.TrimSuffix(filepath.Base(file), ".eml"),
+			header: header,
+			// Bodies are base64 encoded, like the ones from Gmail.
+			message: base64.StdEncoding.EncodeToString(body),
+		})
+	}
+	return p
+}
+
+func (p *fakeProvider) fetch(ctx context.Context) ([]providerMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetches++
+	msgs := make([]providerMessage, len(p.msgs))
+	copy(msgs, p.msgs)
+	return msgs, nil
+}
+
+// scriptedReply is the answer of a scriptedLLM to prompts containing match.
+// The first failures requests fail with errScripted instead.
+type scriptedReply struct {
+	match    string
+	reply    string
+	failures int
+}
+
+var errScripted = errors.New("scripted failure")
+
+// scriptedLLM answers with the first reply that matches the prompt, and
+// streams it word by word. It records the prompts it was sent.
+type scriptedLLM struct {
+	replies []scriptedReply
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (l *scriptedLLM) name() string { return "scripted" }
+
+func (l *scriptedLLM) contextSize() int { return 8192 }
+
+func (l *scriptedLLM) tokens(text string) int { return len(strings.Fields(text)) }
+
+func (l *scriptedLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	l.mu.Lock()
+	l.prompts = append(l.prompts, prompt)
+	reply := "(no scripted reply)"
+	for i := range l.replies {
+		r := &l.replies[i]
+		if strings.Contains(prompt, r.match) {
+			if r.failures > 0 {
+				r.failures--
+				l.mu.Unlock()
+				return "", errScripted
+			}
+			reply = r.reply
+			break
+		}
+	}
+	l.mu.Unlock()
+
+	if delta != nil {
+		for _, word := range strings.SplitAfter(reply, " ") {
+			delta(word)
+		}
+	}
+	return reply, nil
+}
+
+// calls returns the prompts sent so far.
+func (l *scriptedLLM) calls() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.prompts...)
+}
+
+// fakeNotifier records notifications instead of showing them.
+type fakeNotifier struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (n *fakeNotifier) notify(msg string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.msgs = append(n.msgs, msg)
+	return nil
+}
+
+func (n *fakeNotifier) notifications() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.msgs...)
+}
+
+// harness is an app with a fake provider, LLM and notifier, and a database
+// in a temporary directory.
+type harness struct {
+	app      *app
+	provider *fakeProvider
+	llm      *scriptedLLM
+	notifier *fakeNotifier
+	store    *sqliteDB
+	web      *webAPI
+}
+
+func newHarness(t *testing.T, inbox string, replies []scriptedReply) *harness {
+	t.Helper()
+	store, err := newSqlite(filepath.Join(t.TempDir(), dbFile), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.close() })
+	prompts, err := loadPrompts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &harness{
+		provider: newFakeProvider(t, inbox),
+		// The replies count their failures down, so every harness has its
+		// own copy.
+		llm:      &scriptedLLM{replies: append([]scriptedReply{}, replies...)},
+		notifier: &fakeNotifier{},
+		store:    store,
+		web:      &webAPI{done: make(chan struct{})},
+	}
+	t.Cleanup(func() { close(h.web.done) })
+	mbox := newMailbox("test", h.provider, h.llm, prompts, store, "I run the infrastructure team.")
+	h.app = &app{
+		mbox:     mbox,
+		store:    store,
+		web:      h.web,
+		notifier: h.notifier,
+		workers:  2,
+	}
+	return h
+}
+
+// wsClient is a websocket client of the web UI.
+type wsClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// connect opens a websocket to the web UI and waits until it's registered
+// for pushes.
+func (h *harness) connect(t *testing.T) *wsClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(h.web.serveWebsocket))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.web.mu.Lock()
+		n := len(h.web.listeners)
+		h.web.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("websocket wasn't registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return &wsClient{t: t, conn: conn}
+}
+
+// read returns the next pushed message.
+func (c *wsClient) read() webMsg {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, b, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("reading websocket: %v", err)
+	}
+	var msg webMsg
+	if err := json.Unmarshal(b, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// readUntil returns the pushed messages up to and including the first one of
+// the type.
+func (c *wsClient) readUntil(typ string) []webMsg {
+	c.t.Helper()
+	msgs := []webMsg{}
+	for {
+		msg := c.read()
+		msgs = append(msgs, msg)
+		if msg.Type == typ {
+			return msgs
+		}
+	}
+}
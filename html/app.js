@@ -1,5 +1,10 @@
 $(document).ready(function () {
-const ws = new WebSocket('ws://localhost:8080/ws');
+const ws = new WebSocket('ws://' + window.location.host + '/ws');
+
+// Summaries that are still being generated, by message ID.
+const pending = {};
+// Messages that are shown, by message ID.
+const shown = {};
 
 ws.onopen = () => {
     console.log('Connected to the WebSocket server');
@@ -8,18 +13,117 @@ ws.onopen = () => {
 ws.onmessage = (event) => {
     try {
         const messageData = JSON.parse(event.data);
-        if (messageData.Date && messageData.Subject && messageData.From && messageData.Message) {
-            displayMessage(messageData);
+        switch (messageData.Type) {
+        case 'summary_started':
+            startMessage(messageData);
+            break;
+        case 'summary_delta':
+            appendDelta(messageData);
+            break;
+        case 'summary_failed':
+            failMessage(messageData);
+            break;
+        case 'summary_completed':
+            if (messageData.Date && messageData.Subject && messageData.From && messageData.Message) {
+                displayMessage(messageData);
+            }
+            break;
+        case 'newsletters':
+            loadNewsletters();
+            break;
+        case 'auth_required':
+            jQuery('#auth').show();
+            break;
         }
     } catch (e) {
         console.error('Error parsing message data', e);
     }
 };
 
-function displayMessage(data) {
+// api calls the JSON API. The X-Requested-With header is required for
+// anything but GET requests.
+function api(method, url, body) {
+    return jQuery.ajax({
+        method: method,
+        url: url,
+        contentType: 'application/json',
+        data: body === undefined ? undefined : JSON.stringify(body),
+        headers: { 'X-Requested-With': 'mailassist' },
+    });
+}
+
+function loadNewsletters() {
+    api('GET', '/api/newsletters').done(function(newsletters) {
+        const list = jQuery('#newsletter-list').empty();
+        jQuery('#newsletter-count').text(newsletters.length);
+        jQuery('#newsletters').toggle(newsletters.length > 0);
+        newsletters.forEach(function(n) {
+            // Senders and subjects are untrusted, so they're only inserted as text.
+            const item = jQuery('<li></li>');
+            item.append(jQuery('<strong></strong>').text(n.From));
+            item.append(jQuery('<span></span>').text(': ' + n.Subject + ' '));
+            if (n.Unsubscribed) {
+                item.append(jQuery('<em>unsubscribed</em>'));
+            } else if (n.OneClick) {
+                const button = jQuery('<button>Unsubscribe</button>').addClass('button_small');
+                button.on('click', function() {
+                    button.prop('disabled', true);
+                    api('POST', '/api/unsubscribe', { ID: n.ID })
+                        .done(loadNewsletters)
+                        .fail(function(xhr) {
+                            button.prop('disabled', false);
+                            alert('Could not unsubscribe: ' + xhr.responseText);
+                        });
+                });
+                item.append(button);
+            }
+            list.append(item);
+        });
+    });
+}
+
+api('GET', '/api/auth').done(function(auth) {
+    jQuery('#auth').toggle(auth.Required);
+});
+
+jQuery('#newsletter-toggle').on('click', function() {
+    jQuery('#newsletter-list').slideToggle();
+});
+loadNewsletters();
+
+// The summaries of the last week, oldest first, since new ones are
+// prepended.
+api('GET', '/api/messages').done(function(messages) {
+    messages.reverse().forEach(displayMessage);
+});
+
+// arrange sorts the summaries by date or priority score and hides those
+// below the minimum score. Summaries that are still being generated stay on
+// top.
+function arrange() {
+    const minScore = parseInt(jQuery('#min-score').val(), 10) || 0;
+    const byScore = jQuery('#sort').val() === 'score';
+    const messagesDiv = jQuery('#messages');
+    const done = messagesDiv.children('.message').not('.pending').get();
+    done.sort(function(a, b) {
+        const x = jQuery(a).data(), y = jQuery(b).data();
+        if (byScore && x.score !== y.score) {
+            return y.score - x.score;
+        }
+        return y.time - x.time;
+    });
+    messagesDiv.append(done);
+    done.forEach(function(element) {
+        const e = jQuery(element);
+        e.toggle(!e.data('hidden') && e.data('score') >= minScore);
+    });
+}
+jQuery('#sort, #min-score').on('change', arrange);
+
+function createMessage(data) {
     const messagesDiv = jQuery('#messages');
     const messageElement = jQuery('<div></div>').addClass('message');
-    
+
     const messageHTML = `
     <table><tr><td style="width: 90px;">
         <strong>Date:</strong></td><td>${data.Date}</td></tr><tr><td>
@@ -27,16 +131,78 @@ function displayMessage(data) {
         <strong>Subject:</strong></td><td>${data.Subject}</td></tr>
     </table>
     <hr>
-        <div class="message-content">${data.Message}</div>
+        <div class="message-content"></div>
     `;
-    
+
     messageElement.html(messageHTML);
     messagesDiv.prepend(messageElement);
+    shown[data.ID] = true;
+    return messageElement;
+}
+
+function startMessage(data) {
+    const messageElement = createMessage(data);
+    const content = messageElement.find('.message-content');
+    content.addClass('streaming').text('Summarizing...');
+    messageElement.addClass('pending');
+    pending[data.ID] = { element: messageElement, text: '' };
+}
+
+function appendDelta(data) {
+    const p = pending[data.ID];
+    if (!p) {
+        return;
+    }
+    p.text += data.Delta;
+    // Deltas are raw model output, so they're shown as text only.
+    p.element.find('.message-content').text(p.text);
+}
+
+// failMessage removes the message whose summary failed. It's summarized again
+// in the next cycle.
+function failMessage(data) {
+    const p = pending[data.ID];
+    if (!p) {
+        return;
+    }
+    delete pending[data.ID];
+    // Errors can quote the model output, so they're shown as text only.
+    p.element.find('.message-content').removeClass('streaming')
+        .text('Could not summarize the message, trying again later: ' + data.Delta);
+    p.element.delay(5000).slideUp();
+}
+
+function displayMessage(data) {
+    let messageElement;
+    if (!pending[data.ID] && shown[data.ID]) {
+        // Loaded with the summaries of the last week already.
+        return;
+    }
+    if (pending[data.ID]) {
+        messageElement = pending[data.ID].element;
+        delete pending[data.ID];
+    } else {
+        messageElement = createMessage(data);
+    }
+    messageElement.find('.message-content').removeClass('streaming').html(data.Message);
+    messageElement.removeClass('pending').data({ score: data.Score || 0, time: data.Time || 0 });
+
+    const labels = [];
+    if (data.Priority) {
+        const reasons = (data.Reasons || []).join(', ');
+        labels.push(`<span class="priority-${data.Priority}" title="${reasons}">${data.Priority} ${data.Score || 0}</span>`);
+    }
+    (data.Tags || []).forEach(function(tag) {
+        labels.push(`<span class="tag">${tag}</span>`);
+    });
+    if (labels.length > 0) {
+        messageElement.find('table').append(`<tr><td><strong>Labels:</strong></td><td>${labels.join(' ')}</td></tr>`);
+    }
 
     const hideButton = jQuery('<button>Hide</button>');
     hideButton.addClass("button_done");
     hideButton.on('click', function() {
-        messageElement.slideUp();
+        messageElement.data('hidden', true).slideUp();
     });
     messageElement.append(hideButton);
 
@@ -63,6 +229,178 @@ function displayMessage(data) {
         });
     });
     messageElement.append(toggleButton);
+
+    messageElement.append(jQuery('<span> </span>'));
+    const replyButton = jQuery('<button>Reply</button>').addClass('button_done');
+    replyButton.on('click', function() {
+        replyButton.prop('disabled', true);
+        messageElement.append(createReply(data.ID));
+    });
+    messageElement.append(replyButton);
+    messageElement.append(createActions(data.ID, messageElement));
+    messageElement.append(createFeedback(data.ID));
+    arrange();
     $(this).scrollTop(0);
 }
-});
\ No newline at end of file
+
+// createFeedback returns the controls to rate the summary of the message and
+// correct it. Corrections are shown to the LLM in later prompts.
+function createFeedback(id) {
+    const feedback = jQuery('<div></div>').addClass('actions');
+    const status = jQuery('<span></span>');
+
+    function send(kind, fields) {
+        return api('POST', '/api/feedback', Object.assign({ ID: id, Kind: kind }, fields))
+            .done(function() {
+                status.text(' Thanks for the feedback.');
+            })
+            .fail(function(xhr) {
+                status.text(' Could not send feedback: ' + xhr.responseText);
+            });
+    }
+
+    const upButton = jQuery('<button>&#128077;</button>').addClass('button_small').attr('title', 'Good summary');
+    const downButton = jQuery('<button>&#128078;</button>').addClass('button_small').attr('title', 'Bad summary');
+    // A message has one rating, so the chosen one is disabled.
+    function rate(kind, chosen, other) {
+        chosen.on('click', function() {
+            send(kind).done(function() {
+                chosen.prop('disabled', true);
+                other.prop('disabled', false);
+            });
+        });
+    }
+    rate('up', upButton, downButton);
+    rate('down', downButton, upButton);
+
+    const priorityButton = jQuery('<button>Wrong priority</button>').addClass('button_small');
+    priorityButton.on('click', function() {
+        const priority = prompt('Right priority (low, med or high):');
+        if (priority) {
+            send('priority', { Priority: priority.trim().toLowerCase() });
+        }
+    });
+    const actionButton = jQuery('<button>Missed action item</button>').addClass('button_small');
+    actionButton.on('click', function() {
+        const item = prompt('Action item the summary missed:');
+        if (item) {
+            send('missed_action', { ActionItem: item });
+        }
+    });
+
+    feedback.append(upButton, downButton, priorityButton, actionButton, status);
+    return feedback;
+}
+
+// createActions returns the buttons that change the message in the real
+// mailbox.
+function createActions(id, messageElement) {
+    const actions = jQuery('<div></div>').addClass('actions');
+    const status = jQuery('<span></span>');
+
+    function action(name, label) {
+        return api('POST', '/api/action', { ID: id, Action: name, Label: label })
+            .done(function() {
+                status.text('');
+            })
+            .fail(function(xhr) {
+                status.text(' Could not ' + name + ': ' + xhr.responseText);
+            });
+    }
+    // toggle returns a button that switches between two actions.
+    function toggle(on, off, onText, offText) {
+        let active = false;
+        const button = jQuery('<button></button>').addClass('button_small').text(onText);
+        button.on('click', function() {
+            button.prop('disabled', true);
+            action(active ? off : on)
+                .done(function() {
+                    active = !active;
+                    button.text(active ? offText : onText);
+                })
+                .always(function() {
+                    button.prop('disabled', false);
+                });
+        });
+        return button;
+    }
+
+    const archiveButton = jQuery('<button>Archive</button>').addClass('button_small');
+    archiveButton.on('click', function() {
+        archiveButton.prop('disabled', true);
+        action('archive')
+            .done(function() {
+                messageElement.data('hidden', true).slideUp();
+            })
+            .fail(function() {
+                archiveButton.prop('disabled', false);
+            });
+    });
+    // labelButton returns a button that asks for a label and adds it to or
+    // removes it from the message.
+    function labelButton(name, text, question, done) {
+        const button = jQuery('<button></button>').addClass('button_small').text(text);
+        button.on('click', function() {
+            const label = prompt(question);
+            if (label) {
+                action(name, label).done(function() {
+                    status.text(' ' + done + ' ' + label + '.');
+                });
+            }
+        });
+        return button;
+    }
+
+    actions.append(
+        toggle('read', 'unread', 'Mark read', 'Mark unread'),
+        toggle('star', 'unstar', 'Star', 'Unstar'),
+        archiveButton,
+        labelButton('label', 'Label', 'Label (or folder) to apply:', 'Labeled'),
+        labelButton('unlabel', 'Unlabel', 'Label to remove:', 'Removed'),
+        status);
+    return actions;
+}
+
+// createReply returns the form to draft a reply to the message with the
+// ID: the LLM writes the reply following the instruction, and the user can
+// edit it before it's saved as a draft.
+function createReply(id) {
+    const form = jQuery('<div></div>').addClass('reply');
+    const instruction = jQuery('<input type="text" placeholder="What should the reply say? (e.g. accept, propose Thursday)">');
+    const writeButton = jQuery('<button>Write</button>').addClass('button_small');
+    const body = jQuery('<textarea rows="8"></textarea>').hide();
+    const saveButton = jQuery('<button>Save draft</button>').addClass('button_small').hide();
+    const status = jQuery('<span></span>');
+
+    writeButton.on('click', function() {
+        writeButton.prop('disabled', true);
+        status.text(' Writing...');
+        api('POST', '/api/reply', { ID: id, Instruction: instruction.val() })
+            .done(function(reply) {
+                body.val(reply.Body).show();
+                saveButton.show();
+                status.text('');
+            })
+            .fail(function(xhr) {
+                status.text(' Could not write reply: ' + xhr.responseText);
+            })
+            .always(function() {
+                writeButton.prop('disabled', false);
+            });
+    });
+    saveButton.on('click', function() {
+        saveButton.prop('disabled', true);
+        api('POST', '/api/draft', { ID: id, Body: body.val() })
+            .done(function() {
+                status.text(' Saved as draft.');
+            })
+            .fail(function(xhr) {
+                saveButton.prop('disabled', false);
+                status.text(' Could not save draft: ' + xhr.responseText);
+            });
+    });
+
+    form.append(instruction, writeButton, body, saveButton, status);
+    return form;
+}
+});
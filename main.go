@@ -1,17 +1,45 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+// TODO: insert your own bio
+const defaultBio = "I am Luka Napotnik, the VP of Engineering, my primary focus is team output and influence, product quality, infrastructure cost, retention and people growth."
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	var (
 		modelFlag = flag.String("model", "zephyr", "llm model (e.g. mistral, gpt-4, ...)")
 		llmFlag   = flag.String("llm", "ollama", "choose from openai or ollama")
 		tokenFlag = flag.String("token", "XYZ", "some llm require tokem authentication")
+		htmlFlag  = flag.String("html", "", "serve the web UI from this directory instead of the embedded assets")
+
+		bioFlag     = flag.String("bio", defaultBio, "who you are and what you care about, used to prioritize emails")
+		accountFlag = flag.String("account", "default", "name of the mail account")
+		promptsFlag = flag.String("prompts", "", "directory with prompt templates that replace the built-in ones")
+		configFlag  = flag.String("config", "config.json", "configuration file with llms and rules")
+		keyfileFlag = flag.String("keyfile", "", "file with the passphrase that encrypts tokens, secrets and messages (default $MAILASSIST_PASSPHRASE)")
+		authFlag    = flag.String("auth", authBrowser, "how to authorize with Gmail: browser, or headless to paste the redirect address")
+
+		workersFlag     = flag.Int("workers", 4, "number of conversations summarized in parallel")
+		concurrencyFlag = flag.Int("llm-concurrency", 0, "maximum concurrent llm requests (default 1 for ollama, 4 for openai)")
+		contextFlag     = flag.Int("llm-context", 0, "context window of the model in tokens (default depends on the backend and model)")
 
 		ai  LLM
 		err error
@@ -19,47 +47,202 @@ func main() {
 
 	flag.Parse()
 
-	switch *llmFlag {
-	case "ollama":
-		ai, err = newOllama(*modelFlag)
-		if err != nil {
-			log.Fatalf("Could not initialize AI: %v", err)
+	cfg, err := loadConfig(*configFlag)
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+
+	key, err := loadKey(*keyfileFlag)
+	if err != nil {
+		log.Fatalf("Could not load encryption key: %v", err)
+	}
+	if key == nil {
+		log.Println("No passphrase set, tokens and messages are stored unencrypted")
+	}
+	token := *tokenFlag
+	if !flagSet("token") {
+		if token, err = readOpenAIKey(key, token); err != nil {
+			log.Fatalf("Could not read OpenAI key: %v", err)
 		}
-	case "openai":
-		*tokenFlag, _ = os.LookupEnv("OPENAI_KEY")
-		ai, err = newOpenAI(*tokenFlag)
+	}
+
+	model := *modelFlag
+	if *llmFlag == "openai" && !flagSet("model") {
+		// The default model is an ollama one.
+		model = ""
+	}
+	ai, err = newLLM(*llmFlag, model, token, *concurrencyFlag, *contextFlag)
+	if err != nil {
+		log.Fatalf("Could not initialize AI: %v", err)
+	}
+	ai = cfg.redacted(ai, *llmFlag, *accountFlag)
+	llms := make(map[string]LLM)
+	for name, c := range cfg.LLMs {
+		llms[name], err = newLLM(c.Backend, c.Model, token, c.Concurrency, c.Context)
 		if err != nil {
-			log.Fatalf("Could not initialize AI: %v", err)
+			log.Fatalf("Could not initialize AI %q: %v", name, err)
 		}
+		llms[name] = cfg.redacted(llms[name], c.Backend, *accountFlag)
 	}
 
-	// TODO: insert your own bio
-	ai.bio("I am Luka Napotnik, the VP of Engineering, my primary focus is team output and influence, product quality, infrastructure cost, retention and people growth.")
+	prompts, err := loadPrompts(*promptsFlag)
+	if err != nil {
+		log.Fatalf("Could not load prompts: %v", err)
+	}
+	for _, r := range cfg.Rules {
+		if r.Actions.Prompt == "" {
+			continue
+		}
+		if _, err := prompts.get(r.Actions.Prompt); err != nil {
+			log.Fatalf("Rule %q: %v", r.Name, err)
+		}
+	}
+	store, err := newSqlite(dbFile, key)
+	if err != nil {
+		log.Fatalf("Could not open database: %v", err)
+	}
+	usage := newUsageTracker(store, cfg.Prices, cfg.Budget)
+	var fallback LLM
+	if cfg.Budget != nil {
+		fallback = llms[cfg.Budget.Fallback]
+	}
+	ai = cfg.budgeted(ai, usage, fallback)
+	for name := range llms {
+		if fallback == nil || name != cfg.Budget.Fallback {
+			llms[name] = cfg.budgeted(llms[name], usage, fallback)
+		}
+	}
 
-	gmail, err := newGmailProvider("credentials.json", 40)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	gmail, err := newGmailProvider(ctx, key, "credentials.json", *accountFlag, 40, *authFlag)
 	if err != nil {
 		log.Fatalf("Could not initialize Gmail: %v", err)
 	}
 
 	d := newDesktop()
-	web := newWebAPI()
-	db := newLocalDB()
+	var mailer *smtpSender
+	if cfg.SMTP != nil {
+		if mailer, err = newSMTPSender(*cfg.SMTP); err != nil {
+			log.Fatalf("Could not initialize SMTP: %v", err)
+		}
+	}
+	web := newWebAPI(*htmlFlag)
+	web.handleNewsletters(store)
+	web.handleAuth(gmail.auth)
+	gmail.auth.onRevoked = func() {
+		d.notify("mailassist needs to be authorized again")
+		web.pushAuthRequired()
+	}
+	if gmail.auth.authRequired() {
+		// The saved token lacks scopes.
+		gmail.auth.onRevoked()
+	}
+
+	priority := cfg.Priority
+	if priority == nil {
+		priority = &priorityConfig{}
+	}
+	if len(priority.Addresses) == 0 {
+		address, err := gmail.address(ctx)
+		if err != nil {
+			log.Printf("Could not look up the address of the account, direct messages aren't told from copies: %v", err)
+		} else {
+			priority.Addresses = []string{address}
+		}
+	}
 
-	mbox := newMailbox(gmail, ai)
+	mbox := newMailbox(*accountFlag, gmail, ai, prompts, store, *bioFlag)
+	mbox.rules = cfg.Rules
+	mbox.llms = llms
+	mbox.usage = usage
+	mbox.scorer = newPriorityScorer(priority, gmail)
+	web.handleUsage(usage)
+	web.handleReplies(mbox, store, gmail)
+	web.handleActions(store, gmail)
+	web.handleFeedback(mbox, store)
+	web.handleMessages(store)
 
-	for {
-		if err := mbox.fetch(); err != nil {
-			log.Fatalf("Error fetching mail: %v", err)
+	dg := newDigester(mbox, store)
+	web.handleDigest(dg)
+	go dg.schedule(ctx, cfg.Digests, func(dig *digest) {
+		d.notify(dig.title() + " is ready")
+		if mailer != nil && mailer.cfg.Digests {
+			if err := mailer.send(ctx, dig.title(), dig.markdown, dig.html()); err != nil {
+				log.Printf("Could not mail %s digest: %v", dig.period, err)
+			}
+		}
+	})
+
+	a := &app{
+		mbox:     mbox,
+		store:    store,
+		web:      web,
+		notifier: d,
+		mailer:   mailer,
+		usage:    usage,
+		workers:  *workersFlag,
+	}
+	supervise(ctx, 10*time.Minute, func() error {
+		if err := a.runOnce(ctx); err != nil && ctx.Err() == nil {
+			return fmt.Errorf("error processing mail: %v", err)
 		}
-		mbox.summarize(func(from string, date string, subject string, message string, original string) {
-			h := hashMail(date, from, subject)
-			if db.wasRead(h) {
-				return
+		return nil
+	})
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := web.shutdown(shutdownCtx); err != nil {
+		log.Printf("Could not shut down web: %v", err)
+	}
+	if err := store.close(); err != nil {
+		log.Printf("Could not close database: %v", err)
+	}
+}
+
+// supervise calls run every interval until ctx is cancelled. When run fails,
+// it's retried with an exponential backoff instead.
+func supervise(ctx context.Context, interval time.Duration, run func() error) {
+	const (
+		minBackoff = 10 * time.Second
+		maxBackoff = 10 * time.Minute
+	)
+	backoff := time.Duration(0)
+	for ctx.Err() == nil {
+		wait := interval
+		if err := run(); err != nil {
+			if backoff == 0 {
+				backoff = minBackoff
+			} else {
+				backoff = min(2*backoff, maxBackoff)
 			}
-			db.markRead(h)
-			d.notify(subject)
-			web.push(from, date, subject, highlightPriority(markdownMessage(message)), markdownMessage(original))
-		})
-		time.Sleep(10 * time.Minute)
+			wait = backoff
+			log.Printf("%v (retrying in %v)", err, wait)
+		} else {
+			backoff = 0
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
 	}
 }
+
+// flagSet reports whether the flag was given on the command line.
+func flagSet(name string) bool {
+	return flagSetIn(flag.CommandLine, name)
+}
+
+// flagSetIn reports whether the flag of fs was given.
+func flagSetIn(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
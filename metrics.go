@@ -0,0 +1,94 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Pipeline metrics, exported on /metrics.
+var (
+	providerFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mailassist_provider_fetch_duration_seconds",
+		Help:    "Time spent fetching messages from a mail provider.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"provider"})
+	providerFetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_provider_fetch_errors_total",
+		Help: "Failed fetches from a mail provider.",
+	}, []string{"provider"})
+	messagesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_messages_fetched_total",
+		Help: "Messages returned by a mail provider.",
+	}, []string{"provider"})
+	providerActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_provider_actions_total",
+		Help: "Actions applied to messages in the mailbox, by result (ok or error).",
+	}, []string{"provider", "action", "result"})
+	messagesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_messages_skipped_total",
+		Help: "Messages that were not processed, by reason.",
+	}, []string{"reason"})
+
+	llmRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mailassist_llm_request_duration_seconds",
+		Help:    "Time spent waiting for an LLM backend.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"backend"})
+	llmErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_llm_errors_total",
+		Help: "Failed LLM requests.",
+	}, []string{"backend"})
+	llmTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_llm_tokens_total",
+		Help: "Tokens used by LLM requests, by type (prompt or completion).",
+	}, []string{"backend", "type"})
+	longMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_long_messages_total",
+		Help: "Messages too long for the context of the model, by result (chunked or truncated).",
+	}, []string{"result"})
+
+	redactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_redactions_total",
+		Help: "Values redacted from LLM requests, by kind.",
+	}, []string{"kind"})
+
+	summaryCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_summary_cache_lookups_total",
+		Help: "Summary cache lookups, by result (hit or miss).",
+	}, []string{"result"})
+
+	feedbackReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_feedback_total",
+		Help: "Feedback on summaries from the web UI, by kind.",
+	}, []string{"kind"})
+
+	digestsGenerated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_digests_generated_total",
+		Help: "Generated digests, by period and result (ok or error).",
+	}, []string{"period", "result"})
+
+	webClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mailassist_websocket_clients",
+		Help: "Connected websocket clients.",
+	})
+	webPushesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailassist_web_pushes_dropped_total",
+		Help: "Messages not delivered to a websocket client because its queue was full.",
+	}, []string{"type"})
+)
+
+// observeLLM records the outcome of an LLM request that started at start.
+func observeLLM(backend string, start time.Time, err error) {
+	llmRequestDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	if err != nil {
+		llmErrors.WithLabelValues(backend).Inc()
+	}
+}
+
+// countTokens records the token usage reported by an LLM backend.
+func countTokens(backend string, prompt, completion int) {
+	llmTokens.WithLabelValues(backend, "prompt").Add(float64(prompt))
+	llmTokens.WithLabelValues(backend, "completion").Add(float64(completion))
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Ways to authorize mailassist with the provider.
+const (
+	// authBrowser opens the consent page in the browser, which redirects
+	// back to a temporary local listener.
+	authBrowser = "browser"
+	// authHeadless is for machines without a browser: the consent page is
+	// opened on another device, and the address it redirects to is pasted
+	// back on the terminal.
+	authHeadless = "headless"
+)
+
+// authTimeout is how long the user has to complete the consent page.
+const authTimeout = 5 * time.Minute
+
+// errAuthRequired is returned by the token source of an account whose
+// authorization was revoked or expired, until the user authorizes mailassist
+// again.
+var errAuthRequired = errors.New("authorization required, authorize mailassist again in the web UI")
+
+// tokenFile returns the file the token of the account is saved to. The
+// default account keeps using token.json.
+func tokenFile(account string) string {
+	if account == "" || account == "default" {
+		return "token.json"
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == '@':
+			return r
+		}
+		return '_'
+	}, account)
+	return "token-" + name + ".json"
+}
+
+// getClient returns a client authorized for the account. Without a saved
+// token, the user is asked to authorize mailassist first.
+func getClient(ctx context.Context, key *cipherKey, config *oauth2.Config, account, authMode string) (*http.Client, *tokenStore, error) {
+	file := tokenFile(account)
+	tok, scopes, err := tokenFromFile(key, file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// Don't ask for a new token when the saved one can't be decrypted.
+		return nil, nil, err
+	}
+	if err != nil {
+		tok, err = getTokenFromWeb(ctx, config, authMode, os.Stdin)
+		if err != nil {
+			return nil, nil, err
+		}
+		scopes = grantedScopes(config, tok)
+		if missing := missingScopes(config, scopes); len(missing) > 0 {
+			return nil, nil, fmt.Errorf("authorization failed: access to %s wasn't granted", strings.Join(missing, ", "))
+		}
+		if err := saveToken(key, file, tok, scopes); err != nil {
+			return nil, nil, err
+		}
+	}
+	store := newTokenStore(config, key, file, tok, scopes)
+	return oauth2.NewClient(context.Background(), store), store, nil
+}
+
+// grantedScopes returns the scopes a new token was granted. The token
+// response lists them, unless all of the requested scopes were granted.
+func grantedScopes(config *oauth2.Config, tok *oauth2.Token) []string {
+	if s, ok := tok.Extra("scope").(string); ok && s != "" {
+		return strings.Fields(s)
+	}
+	return config.Scopes
+}
+
+// missingScopes returns the scopes of config that aren't in granted.
+func missingScopes(config *oauth2.Config, granted []string) []string {
+	var missing []string
+	for _, scope := range config.Scopes {
+		if !slices.Contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// tokenStore is the token source of an account. Refreshed tokens are saved
+// to its token file. When the refresh token is revoked, requests fail with
+// errAuthRequired until the user authorizes mailassist again from the web
+// UI, instead of the whole application failing.
+type tokenStore struct {
+	config *oauth2.Config
+	key    *cipherKey
+	file   string
+	// onRevoked is called when the refresh token stops working.
+	onRevoked func()
+
+	mu     sync.Mutex
+	src    oauth2.TokenSource
+	saved  string
+	scopes []string
+	// revoked is also set when the token lacks scopes mailassist needs, like
+	// tokens of older versions that asked for fewer.
+	revoked bool
+	// state, verifier and redirect belong to the authorization started from
+	// the web UI.
+	state, verifier, redirect string
+}
+
+func newTokenStore(config *oauth2.Config, key *cipherKey, file string, tok *oauth2.Token, scopes []string) *tokenStore {
+	ts := &tokenStore{
+		config: config,
+		key:    key,
+		file:   file,
+		src:    config.TokenSource(context.Background(), tok),
+		saved:  tok.AccessToken,
+		scopes: scopes,
+	}
+	if missing := missingScopes(config, scopes); len(missing) > 0 {
+		log.Printf("Authorization of %s lacks %s", file, strings.Join(missing, ", "))
+		ts.revoked = true
+	}
+	return ts
+}
+
+// Token implements oauth2.TokenSource.
+func (ts *tokenStore) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.revoked {
+		return nil, errAuthRequired
+	}
+	tok, err := ts.src.Token()
+	if err != nil {
+		var re *oauth2.RetrieveError
+		if errors.As(err, &re) && re.ErrorCode == "invalid_grant" {
+			log.Printf("Authorization of %s was revoked: %v", ts.file, err)
+			ts.revoked = true
+			if ts.onRevoked != nil {
+				go ts.onRevoked()
+			}
+			return nil, errAuthRequired
+		}
+		return nil, err
+	}
+	if tok.AccessToken != ts.saved {
+		// The token was refreshed. The refresh token can change as well,
+		// so it's saved even though the old one would keep working.
+		if err := saveToken(ts.key, ts.file, tok, ts.scopes); err != nil {
+			log.Printf("Could not save refreshed token: %v", err)
+		} else {
+			ts.saved = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
+
+// authRequired reports whether the user has to authorize mailassist again.
+func (ts *tokenStore) authRequired() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.revoked
+}
+
+// authURL starts an authorization from the web UI and returns the address of
+// the consent page. redirect is where the consent page sends the user back
+// to, which must be a loopback address.
+func (ts *tokenStore) authURL(redirect string) (string, error) {
+	state, err := randomState()
+	if err != nil {
+		return "", err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.state = state
+	ts.verifier = oauth2.GenerateVerifier()
+	ts.redirect = redirect
+
+	cfg := *ts.config
+	cfg.RedirectURL = redirect
+	// The consent prompt makes sure Google hands out a new refresh token.
+	return cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce,
+		oauth2.S256ChallengeOption(ts.verifier)), nil
+}
+
+// completeAuth finishes the authorization started with authURL, with the
+// address the consent page redirected to.
+func (ts *tokenStore) completeAuth(ctx context.Context, u *url.URL) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.state == "" {
+		return errors.New("no authorization in progress")
+	}
+	res := parseAuthRedirect(u, ts.state)
+	if res.err != nil {
+		return res.err
+	}
+	cfg := *ts.config
+	cfg.RedirectURL = ts.redirect
+	tok, err := cfg.Exchange(ctx, res.code, oauth2.VerifierOption(ts.verifier))
+	if err != nil {
+		return fmt.Errorf("unable to retrieve token from web: %v", err)
+	}
+	scopes := grantedScopes(ts.config, tok)
+	if missing := missingScopes(ts.config, scopes); len(missing) > 0 {
+		return fmt.Errorf("authorization failed: access to %s wasn't granted", strings.Join(missing, ", "))
+	}
+	if err := saveToken(ts.key, ts.file, tok, scopes); err != nil {
+		return err
+	}
+	ts.src = ts.config.TokenSource(context.Background(), tok)
+	ts.saved = tok.AccessToken
+	ts.scopes = scopes
+	ts.revoked = false
+	ts.state, ts.verifier, ts.redirect = "", "", ""
+	return nil
+}
+
+// getTokenFromWeb runs the loopback flow for installed apps: the redirect URI
+// is a listener on an ephemeral local port, which captures the authorization
+// code. The code is bound to this request with a random state and PKCE.
+// Requests without the state, like those for a favicon, are ignored.
+//
+// In headless mode the browser isn't opened, and the address the consent
+// page redirected to is pasted into input instead, for when the browser runs
+// on another device and can't reach the listener. The listener only shows
+// the address to paste then, so input is the only source of the code and
+// isn't read from anymore once the code is in.
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config, authMode string, input io.Reader) (*oauth2.Token, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to start oauth listener: %v", err)
+	}
+	defer ln.Close()
+
+	cfg := *config
+	cfg.RedirectURL = "http://" + ln.Addr().String() + "/"
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+	authURL := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+	codes := make(chan authResult, 1)
+
+	srv := &http.Server{Handler: loopbackHandler(state, authMode == authHeadless, cfg.RedirectURL, codes)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	switch authMode {
+	case authHeadless:
+		fmt.Printf("Open the following link in a browser on any device and authorize mailassist:\n%v\n\n"+
+			"Then paste the address the browser was redirected to here:\n", authURL)
+		go func() {
+			res := readAuthRedirect(input, state)
+			select {
+			case codes <- res:
+			default:
+			}
+		}()
+	default:
+		fmt.Printf("Authorize mailassist in your browser. If it doesn't open, go to:\n%v\n", authURL)
+		if err := openBrowser(authURL); err != nil {
+			fmt.Printf("Could not open the browser: %v\n", err)
+		}
+	}
+
+	var res authResult
+	select {
+	case res = <-codes:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("authorization not completed: %v", ctx.Err())
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	tok, err := cfg.Exchange(ctx, res.code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
+	}
+	return tok, nil
+}
+
+// loopbackHandler handles the redirects of the consent page to the listener
+// of getTokenFromWeb, and sends the result of the authorization with the
+// state to codes. In headless mode, it only shows the address to paste.
+func loopbackHandler(state string, headless bool, redirect string, codes chan<- authResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != state {
+			http.Error(w, "unknown authorization", http.StatusBadRequest)
+			return
+		}
+		if headless {
+			fmt.Fprintf(w, "Paste this address into the terminal:\n%s\n", redirect+"?"+r.URL.RawQuery)
+			return
+		}
+		res := parseAuthRedirect(r.URL, state)
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "mailassist is authorized, you can close this window.")
+		}
+		// Only the first result counts, the consent page redirects once.
+		select {
+		case codes <- res:
+		default:
+		}
+	})
+}
+
+// readAuthRedirect reads addresses the consent page redirected to from input,
+// until one belongs to the authorization with the state.
+func readAuthRedirect(input io.Reader, state string) authResult {
+	r := bufio.NewReader(input)
+	for {
+		line, err := r.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			u, perr := url.Parse(line)
+			if perr == nil && u.Query().Get("state") == state {
+				return parseAuthRedirect(u, state)
+			}
+			fmt.Println("That's not the address of this authorization, paste the address the browser was redirected to:")
+		}
+		if err != nil {
+			return authResult{err: fmt.Errorf("authorization not completed: %v", err)}
+		}
+	}
+}
+
+type authResult struct {
+	code string
+	err  error
+}
+
+// parseAuthRedirect returns the authorization code from the address the
+// consent page redirected to.
+func parseAuthRedirect(u *url.URL, state string) authResult {
+	q := u.Query()
+	switch {
+	case q.Get("state") != state:
+		return authResult{err: errors.New("authorization failed: state mismatch")}
+	case q.Get("error") != "":
+		return authResult{err: fmt.Errorf("authorization failed: %s", q.Get("error"))}
+	case q.Get("code") == "":
+		return authResult{err: errors.New("authorization failed: missing code")}
+	}
+	return authResult{code: q.Get("code")}
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openBrowser opens the URL in the default browser.
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Start()
+}
+
+// savedToken is a token as it's saved to the token file, along with the
+// scopes it was granted.
+type savedToken struct {
+	oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Retrieves a token and its scopes from a local file. Tokens saved by older
+// versions have no scopes.
+func tokenFromFile(key *cipherKey, file string) (*oauth2.Token, []string, error) {
+	b, err := readSecretFile(key, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var saved savedToken
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, nil, err
+	}
+	return &saved.Token, saved.Scopes, nil
+}
+
+// saveToken writes the token and its scopes, encrypted with key, to a file
+// that only the user can read.
+func saveToken(key *cipherKey, path string, token *oauth2.Token, scopes []string) error {
+	b, err := json.Marshal(savedToken{Token: *token, Scopes: scopes})
+	if err != nil {
+		return err
+	}
+	if err := writeSecretFile(key, path, b); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenScopes(t *testing.T) {
+	config := &oauth2.Config{Scopes: []string{"read", "compose"}}
+	tok := &oauth2.Token{AccessToken: "abc", RefreshToken: "def"}
+
+	tests := []struct {
+		name         string
+		granted      *oauth2.Token
+		want         []string
+		authRequired bool
+	}{
+		{"all requested", tok, []string{"read", "compose"}, false},
+		{"listed", tok.WithExtra(map[string]interface{}{"scope": "compose read other"}), []string{"compose", "read", "other"}, false},
+		{"partly granted", tok.WithExtra(map[string]interface{}{"scope": "read"}), []string{"read"}, true},
+	}
+	for _, tt := range tests {
+		scopes := grantedScopes(config, tt.granted)
+		if !reflect.DeepEqual(scopes, tt.want) {
+			t.Errorf("%s: grantedScopes() = %q, want %q", tt.name, scopes, tt.want)
+		}
+		file := filepath.Join(t.TempDir(), "token.json")
+		if err := saveToken(nil, file, tt.granted, scopes); err != nil {
+			t.Fatal(err)
+		}
+		saved, savedScopes, err := tokenFromFile(nil, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.AccessToken != "abc" || saved.RefreshToken != "def" || !reflect.DeepEqual(savedScopes, scopes) {
+			t.Errorf("%s: read back %+v with %q", tt.name, saved, savedScopes)
+		}
+		ts := newTokenStore(config, nil, file, saved, savedScopes)
+		if ts.authRequired() != tt.authRequired {
+			t.Errorf("%s: authRequired() = %v, want %v", tt.name, ts.authRequired(), tt.authRequired)
+		}
+	}
+
+	// Tokens of older versions don't record their scopes, so they might
+	// lack the ones added since.
+	file := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(file, []byte(`{"access_token":"abc","refresh_token":"def"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved, scopes, err := tokenFromFile(nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTokenStore(config, nil, file, saved, scopes)
+	if _, err := ts.Token(); !errors.Is(err, errAuthRequired) {
+		t.Errorf("Token() of a token without scopes = %v, want errAuthRequired", err)
+	}
+}
+
+func TestReadAuthRedirect(t *testing.T) {
+	tests := []struct {
+		name, input string
+		code        string
+		err         bool
+	}{
+		{"code", "http://127.0.0.1:4321/?state=s1&code=c1\n", "c1", false},
+		{"other authorization first", "http://127.0.0.1:4321/?state=old&code=c0\nnot an address\n\nhttp://127.0.0.1:4321/?state=s1&code=c1\n", "c1", false},
+		{"denied", "http://127.0.0.1:4321/?state=s1&error=access_denied\n", "", true},
+		{"denied other authorization", "http://127.0.0.1:4321/?error=access_denied\nhttp://127.0.0.1:4321/?state=s1&code=c1", "c1", false},
+		{"no address", "http://127.0.0.1:4321/?state=old&code=c0\n", "", true},
+	}
+	for _, tt := range tests {
+		res := readAuthRedirect(strings.NewReader(tt.input), "s1")
+		if res.code != tt.code || (res.err != nil) != tt.err {
+			t.Errorf("%s: readAuthRedirect() = %q, %v", tt.name, res.code, res.err)
+		}
+	}
+}
+
+func TestLoopbackHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		headless bool
+		requests []string
+		code     string
+		err      bool
+	}{
+		{"code", false, []string{"/?state=s1&code=c1"}, "c1", false},
+		// Requests of others are ignored rather than ending the
+		// authorization.
+		{"ignored", false, []string{"/favicon.ico", "/?state=old&code=c0", "/?error=access_denied", "/?state=s1&code=c1"}, "c1", false},
+		{"denied", false, []string{"/?state=s1&error=access_denied"}, "", true},
+		{"headless", true, []string{"/?state=s1&code=c1"}, "", false},
+	}
+	for _, tt := range tests {
+		codes := make(chan authResult, 1)
+		h := loopbackHandler("s1", tt.headless, "http://127.0.0.1:4321/", codes)
+		for _, target := range tt.requests {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+		}
+		select {
+		case res := <-codes:
+			if res.code != tt.code || (res.err != nil) != tt.err {
+				t.Errorf("%s: got %q, %v", tt.name, res.code, res.err)
+			}
+		default:
+			if tt.code != "" || tt.err {
+				t.Errorf("%s: no result", tt.name)
+			}
+		}
+	}
+}
+
+// fakeTokenSource hands out its tokens and errors in turn, and counts the
+// requests.
+type fakeTokenSource struct {
+	results  []fakeToken
+	requests int
+}
+
+type fakeToken struct {
+	tok *oauth2.Token
+	err error
+}
+
+func (s *fakeTokenSource) Token() (*oauth2.Token, error) {
+	r := s.results[min(s.requests, len(s.results)-1)]
+	s.requests++
+	return r.tok, r.err
+}
+
+func TestTokenStore(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token.json")
+	key, _, err := newKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &oauth2.Config{Scopes: []string{"read"}}
+	tok := &oauth2.Token{AccessToken: "a1", RefreshToken: "r1"}
+	if err := saveToken(key, file, tok, config.Scopes); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTokenStore(config, key, file, tok, config.Scopes)
+	revoked := make(chan bool, 1)
+	ts.onRevoked = func() { revoked <- true }
+	src := &fakeTokenSource{results: []fakeToken{
+		{tok: tok},
+		{tok: &oauth2.Token{AccessToken: "a2", RefreshToken: "r2"}},
+		{err: errors.New("network is down")},
+		{err: &oauth2.RetrieveError{ErrorCode: "invalid_grant"}},
+	}}
+	ts.src = src
+
+	// A token that wasn't refreshed isn't saved again.
+	if got, err := ts.Token(); err != nil || got.AccessToken != "a1" {
+		t.Fatalf("Token() = %v, %v", got, err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("unchanged token was saved again: %v, %v", info.Mode(), err)
+	}
+
+	// Refreshed tokens replace the file, which only the user can read.
+	if got, err := ts.Token(); err != nil || got.AccessToken != "a2" {
+		t.Fatalf("Token() = %v, %v", got, err)
+	}
+	saved, scopes, err := tokenFromFile(key, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "a2" || saved.RefreshToken != "r2" || !reflect.DeepEqual(scopes, config.Scopes) {
+		t.Errorf("saved %+v with %q", saved, scopes)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("refreshed token saved with mode %v, %v", info.Mode(), err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("saving left %q", files)
+	}
+
+	// Other errors are passed on.
+	if _, err := ts.Token(); err == nil || errors.Is(err, errAuthRequired) || ts.authRequired() {
+		t.Errorf("Token() with a network error = %v", err)
+	}
+
+	// A revoked refresh token asks the user to authorize mailassist again,
+	// without trying the token source anymore.
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(); !errors.Is(err, errAuthRequired) {
+			t.Errorf("Token() after invalid_grant = %v, want errAuthRequired", err)
+		}
+	}
+	if !ts.authRequired() {
+		t.Error("authRequired() = false after invalid_grant")
+	}
+	if src.requests != 4 {
+		t.Errorf("token source got %d requests, want 4", src.requests)
+	}
+	select {
+	case <-revoked:
+	case <-time.After(5 * time.Second):
+		t.Error("onRevoked wasn't called")
+	}
+	if saved, _, err := tokenFromFile(key, file); err != nil || saved.AccessToken != "a2" {
+		t.Errorf("token file changed to %+v, %v", saved, err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// pipelineHooks connect the pipeline to the rest of the application.
+type pipelineHooks struct {
+	// skip drops messages before they are summarized, e.g. because they
+	// were already processed in an earlier cycle.
+	skip func(m *mailMessage) bool
+	// started and delta report the progress of a summary. They are called
+	// from the worker goroutines.
+	started func(m *mailMessage)
+	delta   func(m *mailMessage, text string)
+	// failed reports a message that couldn't be summarized. It isn't stored,
+	// so the next cycle tries again.
+	failed func(m *mailMessage, err error)
+	// store and notify receive finished summaries one at a time, and in
+	// order within a conversation. Bulk mail and messages that rules exclude
+	// from the LLM are only stored, with an empty summary.
+	store  func(m *mailMessage, summary string) error
+	notify func(m *mailMessage, summary string)
+	// newsletters receives the bulk mail stored in the cycle.
+	newsletters func(msgs []*mailMessage)
+}
+
+// pipeline processes a polling cycle in stages:
+// fetch → parse → summarize → store → notify.
+//
+// Summarizing is done by a pool of workers. A conversation is always handled
+// by a single worker, so its messages are summarized and delivered in order.
+// How many requests actually reach a backend at once is limited by the
+// backend itself (see limitedLLM).
+type pipeline struct {
+	mbox    *mailBox
+	workers int
+	hooks   pipelineHooks
+}
+
+type summarizedMessage struct {
+	msg     *mailMessage
+	summary string
+}
+
+func newPipeline(mbox *mailBox, workers int, hooks pipelineHooks) *pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	return &pipeline{
+		mbox:    mbox,
+		workers: workers,
+		hooks:   hooks,
+	}
+}
+
+// run processes one polling cycle. It returns when every message was
+// delivered, or when ctx is cancelled.
+func (p *pipeline) run(ctx context.Context) error {
+	msgs, err := p.mbox.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	p.mbox.loadCorrections()
+	conversations := p.filter(p.mbox.parse(msgs))
+
+	jobs := make(chan *mailConversation)
+	results := make(chan summarizedMessage)
+	// Summarizing stops early once the budget is spent. The messages that
+	// weren't summarized yet aren't stored, so a later cycle picks them up.
+	summarizeCtx, pause := context.WithCancel(ctx)
+	defer pause()
+
+	go func() {
+		defer close(jobs)
+		for _, c := range conversations {
+			select {
+			case jobs <- c:
+			case <-summarizeCtx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				p.summarize(summarizeCtx, c, results, pause)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	newsletters := []*mailMessage{}
+	for r := range results {
+		if p.hooks.store != nil {
+			if err := p.hooks.store(r.msg, r.summary); err != nil {
+				log.Printf("Could not store message %q: %v", r.msg.conversation.subject, err)
+				continue
+			}
+		}
+		if r.msg.bulk != nil {
+			newsletters = append(newsletters, r.msg)
+		}
+		if p.hooks.notify != nil && r.msg.summarized() {
+			p.hooks.notify(r.msg, r.summary)
+		}
+	}
+	if p.hooks.newsletters != nil && len(newsletters) > 0 {
+		p.hooks.newsletters(newsletters)
+	}
+	return ctx.Err()
+}
+
+// filter removes skipped messages and messages that appear more than once in
+// the same cycle, and drops conversations that end up empty.
+func (p *pipeline) filter(conversations []*mailConversation) []*mailConversation {
+	seen := make(map[string]bool)
+	filtered := []*mailConversation{}
+	for _, c := range conversations {
+		messages := []mailMessage{}
+		for i := range c.messages {
+			m := &c.messages[i]
+			id := m.id()
+			if seen[id] || (p.hooks.skip != nil && p.hooks.skip(m)) {
+				continue
+			}
+			seen[id] = true
+			messages = append(messages, *m)
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		c.messages = messages
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// summarize summarizes the messages of a conversation in order and hands them
+// to the store stage. It calls pause when the budget is spent.
+func (p *pipeline) summarize(ctx context.Context, c *mailConversation, results chan<- summarizedMessage, pause func()) {
+	for i := range c.messages {
+		m := &c.messages[i]
+		if ctx.Err() != nil {
+			return
+		}
+		if !m.summarized() {
+			if m.bulk != nil {
+				messagesSkipped.WithLabelValues("bulk").Inc()
+			}
+			select {
+			case results <- summarizedMessage{msg: m}:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		if p.hooks.started != nil {
+			p.hooks.started(m)
+		}
+		summary, err := m.summaryStream(ctx, func(text string) {
+			if p.hooks.delta != nil {
+				p.hooks.delta(m, text)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errBudgetExceeded) {
+			log.Println("The monthly llm budget is spent, summarizing is paused")
+			messagesSkipped.WithLabelValues("budget").Inc()
+			if p.hooks.failed != nil {
+				p.hooks.failed(m, err)
+			}
+			pause()
+			return
+		}
+		if err != nil {
+			log.Printf("Could not summarize %q: %v", c.subject, err)
+			messagesSkipped.WithLabelValues("error").Inc()
+			if p.hooks.failed != nil {
+				p.hooks.failed(m, err)
+			}
+			continue
+		}
+		m.priority = p.mbox.scorer.score(ctx, m, summary)
+		select {
+		case results <- summarizedMessage{msg: m, summary: summary}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
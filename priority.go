@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The priority score of a message goes from 0 to 100. The urgency and the
+// importance the LLM sees in the message make up most of it, and signals
+// about the sender move it up or down.
+const (
+	// scoreLevel is added for each level of urgency and of importance above
+	// low.
+	scoreLevel = 20
+	// scoreVIP is added for senders on the VIP list.
+	scoreVIP = 25
+	// scoreReplied is added for senders the user wrote to before.
+	scoreReplied = 10
+	// scoreOrg is added for senders from the organization of the user.
+	scoreOrg = 5
+	// scoreDirect is added for messages addressed to the user, and
+	// scoreIndirect for messages that reached them through a list or Bcc.
+	scoreDirect   = 5
+	scoreIndirect = -10
+
+	// Scores from scoreHigh up are high priority and from scoreMed up medium
+	// priority.
+	scoreHigh = 60
+	scoreMed  = 30
+)
+
+// sentCountTTL is how long the number of messages sent to a sender is
+// remembered.
+const sentCountTTL = 24 * time.Hour
+
+// priorityConfig configures the priority score of messages.
+type priorityConfig struct {
+	// Addresses are the addresses of the user, which tell messages sent to
+	// them from messages they are copied on. Gmail accounts default to the
+	// address of the account.
+	Addresses []string `json:"addresses"`
+	// VIPs are senders whose messages matter more, by address, or by
+	// domain when they start with "@".
+	VIPs []string `json:"vips"`
+	// Domains are the domains of the organization of the user. They default
+	// to the domains of Addresses.
+	Domains []string `json:"domains"`
+	// Notify is the lowest score of messages that show a notification.
+	Notify int `json:"notify"`
+}
+
+func (c *priorityConfig) check() error {
+	if c.Notify < 0 || c.Notify > 100 {
+		return errors.New("priority: notify must be between 0 and 100")
+	}
+	for _, vip := range c.VIPs {
+		if strings.Trim(vip, "@ ") == "" {
+			return errors.New("priority: empty vip")
+		}
+	}
+	return nil
+}
+
+// sentMailCounter is implemented by providers that can count the messages
+// the user sent to an address, which is the reply history of a sender.
+type sentMailCounter interface {
+	sentTo(ctx context.Context, address string) (int, error)
+}
+
+// priorityScore is the priority of a message.
+type priorityScore struct {
+	Score int
+	// Level is low, med or high.
+	Level string
+	// Reasons explain the score, like "urgency high" or "vip".
+	Reasons []string
+}
+
+// priorityScorer scores messages. A nil scorer only uses the summary.
+type priorityScorer struct {
+	cfg  priorityConfig
+	sent sentMailCounter
+
+	mu         sync.Mutex
+	sentCounts map[string]sentCount
+}
+
+type sentCount struct {
+	n       int
+	checked time.Time
+}
+
+// newPriorityScorer returns a scorer with the config, which can be nil. The
+// reply history is looked up with sent, unless it's nil.
+func newPriorityScorer(cfg *priorityConfig, sent sentMailCounter) *priorityScorer {
+	s := &priorityScorer{sent: sent, sentCounts: make(map[string]sentCount)}
+	if cfg == nil {
+		return s
+	}
+	s.cfg.Notify = cfg.Notify
+	for _, a := range cfg.Addresses {
+		s.cfg.Addresses = append(s.cfg.Addresses, strings.ToLower(strings.TrimSpace(a)))
+	}
+	for _, vip := range cfg.VIPs {
+		s.cfg.VIPs = append(s.cfg.VIPs, strings.ToLower(strings.TrimSpace(vip)))
+	}
+	for _, d := range cfg.Domains {
+		s.cfg.Domains = append(s.cfg.Domains, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@")))
+	}
+	if len(s.cfg.Domains) == 0 {
+		for _, a := range s.cfg.Addresses {
+			if d := addressDomain(a); d != "" && !contains(s.cfg.Domains, d) {
+				s.cfg.Domains = append(s.cfg.Domains, d)
+			}
+		}
+	}
+	return s
+}
+
+// score combines the classification of the summary with the signals about
+// the sender of m. Rules that set a priority keep the score within that
+// priority.
+func (s *priorityScorer) score(ctx context.Context, m *mailMessage, summary string) priorityScore {
+	p := scoreSummary(summary)
+	if s == nil {
+		s = &priorityScorer{}
+	}
+	add := func(points int, reason string) {
+		p.Score += points
+		p.Reasons = append(p.Reasons, reason)
+	}
+
+	from := parseAddress(m.from)
+	if from != "" {
+		if s.vip(from) {
+			add(scoreVIP, "vip")
+		}
+		if contains(s.cfg.Domains, addressDomain(from)) {
+			add(scoreOrg, "organization")
+		}
+		if s.repliedTo(ctx, from) {
+			add(scoreReplied, "replied before")
+		}
+	}
+	if len(s.cfg.Addresses) > 0 {
+		switch {
+		case s.addressed(m.header["To"]):
+			add(scoreDirect, "direct")
+		case s.addressed(m.header["Cc"]):
+			p.Reasons = append(p.Reasons, "cc")
+		default:
+			add(scoreIndirect, "indirect")
+		}
+	}
+
+	p.Score = min(max(p.Score, 0), 100)
+	if forced := m.actions.Priority; forced != "" {
+		lo, hi := levelRange(forced)
+		p.Score = min(max(p.Score, lo), hi)
+		p.Reasons = append(p.Reasons, "rule")
+	}
+	p.Level = scoreLevelOf(p.Score)
+	return p
+}
+
+// vip reports whether the address is on the VIP list.
+func (s *priorityScorer) vip(address string) bool {
+	for _, vip := range s.cfg.VIPs {
+		if vip == address || (strings.HasPrefix(vip, "@") && vip[1:] == addressDomain(address)) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressed reports whether one of the addresses of the user is in the
+// address list.
+func (s *priorityScorer) addressed(list string) bool {
+	if list == "" {
+		return false
+	}
+	addresses, err := mail.ParseAddressList(list)
+	if err != nil {
+		// Lists that don't parse are still searched for the addresses.
+		list = strings.ToLower(list)
+		for _, a := range s.cfg.Addresses {
+			if strings.Contains(list, a) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, a := range addresses {
+		if contains(s.cfg.Addresses, strings.ToLower(a.Address)) {
+			return true
+		}
+	}
+	return false
+}
+
+// repliedTo reports whether the user sent messages to the address before.
+// The counts are cached, so senders aren't looked up for every message.
+func (s *priorityScorer) repliedTo(ctx context.Context, address string) bool {
+	if s.sent == nil {
+		return false
+	}
+	s.mu.Lock()
+	c, ok := s.sentCounts[address]
+	s.mu.Unlock()
+	if !ok || time.Since(c.checked) > sentCountTTL {
+		n, err := s.sent.sentTo(ctx, address)
+		if err != nil {
+			log.Printf("Could not look up messages sent to %s: %v", address, err)
+			return false
+		}
+		c = sentCount{n: n, checked: time.Now()}
+		s.mu.Lock()
+		s.sentCounts[address] = c
+		s.mu.Unlock()
+	}
+	return c.n > 0
+}
+
+// notifies reports whether a message with the priority shows a
+// notification.
+func (s *priorityScorer) notifies(p priorityScore) bool {
+	return s == nil || p.Score >= s.cfg.Notify
+}
+
+var (
+	urgencyLine    = regexp.MustCompile(`(?i)\burgency\W{1,4}(high|medium|med|low)\b`)
+	importanceLine = regexp.MustCompile(`(?i)\bimportance\W{1,4}(high|medium|med|low)\b`)
+)
+
+// scoreSummary scores the urgency and importance the LLM classified the
+// message with. Summaries without the classification, e.g. from custom
+// prompts, are scored by their highest priority qualifier.
+func scoreSummary(summary string) priorityScore {
+	p := priorityScore{Reasons: []string{}}
+	fallback := summaryPriority(summary)
+	for _, c := range []struct {
+		name string
+		re   *regexp.Regexp
+	}{
+		{"urgency", urgencyLine},
+		{"importance", importanceLine},
+	} {
+		level := fallback
+		if match := c.re.FindStringSubmatch(summary); match != nil {
+			level = normalizePriority(match[1])
+		}
+		if level == "" {
+			continue
+		}
+		p.Score += (2 - priorityRank(level)) * scoreLevel
+		p.Reasons = append(p.Reasons, c.name+" "+level)
+	}
+	p.Level = scoreLevelOf(p.Score)
+	return p
+}
+
+// scoreLevelOf returns the priority of a score.
+func scoreLevelOf(score int) string {
+	switch {
+	case score >= scoreHigh:
+		return "high"
+	case score >= scoreMed:
+		return "med"
+	}
+	return "low"
+}
+
+// levelRange returns the lowest and highest score of a priority.
+func levelRange(level string) (int, int) {
+	switch level {
+	case "high":
+		return scoreHigh, 100
+	case "med":
+		return scoreMed, scoreHigh - 1
+	}
+	return 0, scoreMed - 1
+}
+
+var priorityQualifier = regexp.MustCompile(`(?i)\b(high|medium|med|low)\b`)
+
+// summaryPriority returns the highest priority qualifier in the summary.
+func summaryPriority(summary string) string {
+	priority := ""
+	for _, q := range priorityQualifier.FindAllString(summary, -1) {
+		q = normalizePriority(q)
+		if priorityRank(q) < priorityRank(priority) {
+			priority = q
+		}
+	}
+	return priority
+}
+
+func normalizePriority(q string) string {
+	q = strings.ToLower(q)
+	if q == "medium" {
+		return "med"
+	}
+	return q
+}
+
+// parseAddress returns the lowercased address of a From header, or an empty
+// string if it doesn't parse.
+func parseAddress(from string) string {
+	a, err := mail.ParseAddress(from)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(a.Address)
+}
+
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return strings.ToLower(address[i+1:])
+	}
+	return ""
+}
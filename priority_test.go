@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSummaryPriority(t *testing.T) {
+	tests := []struct {
+		summary string
+		want    string
+	}{
+		{"- Approve the budget (med)\n- Reply to Bob (low)", "med"},
+		{"Priority: HIGH. Follow up with the team.", "high"},
+		{"Follow up on the highlights", ""},
+		{"Medium urgency", "med"},
+	}
+	for _, tt := range tests {
+		if got := summaryPriority(tt.summary); got != tt.want {
+			t.Errorf("summaryPriority(%q) = %q, want %q", tt.summary, got, tt.want)
+		}
+	}
+}
+
+func TestScoreSummary(t *testing.T) {
+	tests := []struct {
+		summary string
+		want    priorityScore
+	}{
+		{
+			"- Approve the budget (low)\nUrgency: high. Importance: medium.",
+			priorityScore{Score: 60, Level: "high", Reasons: []string{"urgency high", "importance med"}},
+		},
+		{
+			"- Lunch on Friday\n\n**Urgency**: low, **importance**: med",
+			priorityScore{Score: 20, Level: "low", Reasons: []string{"urgency low", "importance med"}},
+		},
+		// Without the classification, the highest qualifier counts for
+		// both.
+		{
+			"- Approve the budget (med)\n- Reply to Bob (low)",
+			priorityScore{Score: 40, Level: "med", Reasons: []string{"urgency med", "importance med"}},
+		},
+		{
+			"Follow up on the highlights",
+			priorityScore{Score: 0, Level: "low", Reasons: []string{}},
+		},
+	}
+	for _, tt := range tests {
+		if got := scoreSummary(tt.summary); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scoreSummary(%q) = %+v, want %+v", tt.summary, got, tt.want)
+		}
+	}
+}
+
+// fakeSentMail counts the messages sent to addresses, and the lookups.
+type fakeSentMail struct {
+	sent    map[string]int
+	lookups int
+}
+
+func (f *fakeSentMail) sentTo(ctx context.Context, address string) (int, error) {
+	f.lookups++
+	return f.sent[address], nil
+}
+
+func TestPriorityScorer(t *testing.T) {
+	sent := &fakeSentMail{sent: map[string]int{"bob@partner.example": 3}}
+	scorer := newPriorityScorer(&priorityConfig{
+		Addresses: []string{"Me@Example.com"},
+		VIPs:      []string{"ceo@example.com", "@board.example"},
+		Notify:    30,
+	}, sent)
+
+	const medSummary = "Urgency: med. Importance: med."
+	tests := []struct {
+		name     string
+		from     string
+		header   map[string]string
+		forced   string
+		summary  string
+		want     int
+		reasons  []string
+		notifies bool
+	}{
+		{
+			name:    "vip from the organization",
+			from:    "The CEO <ceo@example.com>",
+			header:  map[string]string{"To": "me@example.com"},
+			summary: medSummary,
+			want:    40 + scoreVIP + scoreOrg + scoreDirect,
+			reasons: []string{"urgency med", "importance med", "vip", "organization", "direct"},
+		},
+		{
+			name:    "vip domain, copied",
+			from:    "chair@board.example",
+			header:  map[string]string{"To": "ceo@example.com", "Cc": "Me <me@example.com>"},
+			summary: medSummary,
+			want:    40 + scoreVIP,
+			reasons: []string{"urgency med", "importance med", "vip", "cc"},
+		},
+		{
+			name:    "replied before",
+			from:    "Bob <bob@partner.example>",
+			header:  map[string]string{"To": "team@example.com, me@example.com"},
+			summary: medSummary,
+			want:    40 + scoreReplied + scoreDirect,
+			reasons: []string{"urgency med", "importance med", "replied before", "direct"},
+		},
+		{
+			name:    "through a list",
+			from:    "someone@other.example",
+			header:  map[string]string{"To": "all@lists.example"},
+			summary: "Urgency: low. Importance: low.",
+			want:    0,
+			reasons: []string{"urgency low", "importance low", "indirect"},
+		},
+		{
+			name:    "rule keeps the score within the priority",
+			from:    "ceo@example.com",
+			header:  map[string]string{"To": "me@example.com"},
+			forced:  "med",
+			summary: "Urgency: high. Importance: high.",
+			want:    scoreHigh - 1,
+			reasons: []string{"urgency high", "importance high", "vip", "organization", "direct", "rule"},
+		},
+	}
+	for _, tt := range tests {
+		m := &mailMessage{from: tt.from, header: tt.header, actions: ruleActions{Priority: tt.forced}}
+		p := scorer.score(context.Background(), m, tt.summary)
+		if p.Score != tt.want || p.Level != scoreLevelOf(tt.want) || !reflect.DeepEqual(p.Reasons, tt.reasons) {
+			t.Errorf("%s: got %+v, want score %d and reasons %q", tt.name, p, tt.want, tt.reasons)
+		}
+		if notifies := scorer.notifies(p); notifies != (tt.want >= 30) {
+			t.Errorf("%s: notifies = %v", tt.name, notifies)
+		}
+	}
+
+	// Every sender is looked up once.
+	if sent.lookups != 4 {
+		t.Errorf("looked up sent mail %d times, want 4", sent.lookups)
+	}
+}
+
+func TestHighlightPriority(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{
+			"<li>Approve the budget (High)</li>",
+			`<li>Approve the budget (<span class="priority-high">High</span>)</li>`,
+		},
+		{
+			"<p>Follow up on the highlights, medium term</p>",
+			`<p>Follow up on the highlights, <span class="priority-med">medium</span> term</p>`,
+		},
+		{
+			`<a href="https://example.com/low">slow</a> low`,
+			`<a href="https://example.com/low">slow</a> <span class="priority-low">low</span>`,
+		},
+	}
+	for _, tt := range tests {
+		if got := highlightPriority(tt.html); got != tt.want {
+			t.Errorf("highlightPriority(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
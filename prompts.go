@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+//go:embed prompts/*.tmpl
+var embeddedPrompts embed.FS
+
+// Prompt templates, one per task. Each template file defines a "system" and
+// a "prompt" template, and a "version" that should be bumped whenever the
+// prompt changes meaningfully.
+const (
+	promptSummary = "summary"
+	promptActions = "actions"
+	promptReply   = "reply"
+	promptDigest  = "digest"
+	// promptChunk summarizes a part of a message that is too long for the
+	// context of the model.
+	promptChunk = "chunk"
+)
+
+// promptData holds the variables available to prompt templates.
+type promptData struct {
+	Bio          string
+	Account      string
+	Sender       string
+	Subject      string
+	Date         string
+	Participants []string
+	Message      string
+	// Chunked is set when Message holds the summaries of the parts of a
+	// message that was too long, instead of the message itself.
+	Chunked bool
+	// Part and Parts number the part of a long message in Message.
+	Part, Parts int
+	// Corrections are the latest corrections the user made to summaries,
+	// newest first.
+	Corrections []promptCorrection
+
+	// Instruction is what the user wants a reply to say.
+	Instruction string
+	// Summaries are the messages covered by a digest.
+	Summaries []promptEntry
+}
+
+// promptEntry is a summarized message in a digest.
+type promptEntry struct {
+	Sender   string
+	Subject  string
+	Date     string
+	Priority string
+	Summary  string
+}
+
+// promptCorrection is a correction the user made to an earlier summary.
+type promptCorrection struct {
+	Sender  string
+	Subject string
+	// Priority is the right priority and Was the priority of the summary,
+	// when the priority was corrected.
+	Priority string
+	Was      string
+	// ActionItem is an action item the summary missed.
+	ActionItem string
+}
+
+type promptTemplate struct {
+	name    string
+	version string
+	tmpl    *template.Template
+}
+
+// promptSet holds the prompt templates, by task.
+type promptSet struct {
+	templates map[string]*promptTemplate
+}
+
+var promptFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// loadPrompts loads the built-in prompt templates. Templates in dir, if it's
+// set, replace the built-in template with the same name.
+func loadPrompts(dir string) (*promptSet, error) {
+	set := &promptSet{templates: make(map[string]*promptTemplate)}
+	if err := set.load(embeddedPrompts, "prompts"); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := set.load(os.DirFS(dir), "."); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+func (set *promptSet) load(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(path.Base(file), ".tmpl")
+		t, err := parsePrompt(name, string(b))
+		if err != nil {
+			return fmt.Errorf("prompt %s: %v", file, err)
+		}
+		set.templates[name] = t
+	}
+	return nil
+}
+
+func parsePrompt(name, text string) (*promptTemplate, error) {
+	tmpl, err := template.New(name).Funcs(promptFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, required := range []string{"system", "prompt"} {
+		if tmpl.Lookup(required) == nil {
+			return nil, fmt.Errorf("missing %q template", required)
+		}
+	}
+	version := "0"
+	if tmpl.Lookup("version") != nil {
+		var b bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&b, "version", nil); err != nil {
+			return nil, err
+		}
+		version = strings.TrimSpace(b.String())
+	}
+	return &promptTemplate{
+		name: name,
+		// The content hash makes sure edits invalidate cached results, even
+		// when the declared version isn't bumped.
+		version: version + "-" + hashString(text)[:8],
+		tmpl:    tmpl,
+	}, nil
+}
+
+func (set *promptSet) get(name string) (*promptTemplate, error) {
+	t, ok := set.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("no prompt template %q", name)
+	}
+	return t, nil
+}
+
+// render returns the system and user prompt for data.
+func (t *promptTemplate) render(data promptData) (string, string, error) {
+	var system, prompt bytes.Buffer
+	if err := t.tmpl.ExecuteTemplate(&system, "system", data); err != nil {
+		return "", "", err
+	}
+	if err := t.tmpl.ExecuteTemplate(&prompt, "prompt", data); err != nil {
+		return "", "", err
+	}
+	return system.String(), prompt.String(), nil
+}
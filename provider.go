@@ -2,101 +2,94 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
-	"log"
-	"net/http"
-	"os"
+	"net/textproto"
+	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 )
 
 type mailProvider interface {
-	fetch() ([]providerMessage, error)
+	fetch(ctx context.Context) ([]providerMessage, error)
 }
 
-type providerMessage struct {
-	header  map[string]string
-	message string
-}
-
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
-	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
-	}
-	return config.Client(context.Background(), tok)
+// draftSaver is implemented by providers that can store reply drafts.
+type draftSaver interface {
+	// saveDraft stores the draft and returns its ID.
+	saveDraft(ctx context.Context, d *replyDraft) (string, error)
 }
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
-
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
-	}
+// Actions on messages in the mailbox of the provider.
+const (
+	actionRead    = "read"
+	actionUnread  = "unread"
+	actionArchive = "archive"
+	actionStar    = "star"
+	actionUnstar  = "unstar"
+	// actionLabel and actionUnlabel add and remove a label, or move the
+	// message to and out of a folder for providers with folders.
+	actionLabel   = "label"
+	actionUnlabel = "unlabel"
+)
 
-	tok, err := config.Exchange(context.TODO(), authCode)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
-	}
-	return tok
+// mailModifier is implemented by providers that can change messages in the
+// mailbox, so handling a message in mailassist is reflected there.
+type mailModifier interface {
+	// modify applies the action to the message with the provider ID. label
+	// is only used by actionLabel and actionUnlabel.
+	modify(ctx context.Context, id, action, label string) error
 }
 
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+type providerMessage struct {
+	// id is the provider's own ID for the message, and threadID the ID of
+	// its thread, if the provider has threads.
+	id       string
+	threadID string
+	// header is keyed by canonical header names (see
+	// textproto.CanonicalMIMEHeaderKey).
+	header  map[string]string
+	message string
 }
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
-	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+// messageID returns the RFC 5322 Message-ID of the message, if it has one.
+func (m *providerMessage) messageID() string {
+	return strings.TrimSpace(m.header["Message-Id"])
 }
 
 type gmailProvider struct {
 	prefetchN int
 	service   *gmail.Service
+	auth      *tokenStore
+
+	mu sync.Mutex
+	// labels maps label names to IDs.
+	labels map[string]string
 }
 
-func newGmailProvider(credsFile string, prefetchN int) (*gmailProvider, error) {
-	ctx := context.Background()
-	b, err := os.ReadFile(credsFile)
+// newGmailProvider connects to Gmail. Without a saved token, the user is
+// asked to authorize mailassist first (see getTokenFromWeb).
+func newGmailProvider(ctx context.Context, key *cipherKey, credsFile, account string, prefetchN int, authMode string) (*gmailProvider, error) {
+	b, err := readSecretFile(key, credsFile)
 	if err != nil {
 		return nil, err
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	// The compose scope is needed to save reply drafts, and the modify scope
+	// to mark messages read, archive, label and star them. Tokens without
+	// one of the scopes have to be authorized again.
+	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope, gmail.GmailComposeScope, gmail.GmailModifyScope)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
 	}
-	client := getClient(config)
+	client, auth, err := getClient(ctx, key, config, account, authMode)
+	if err != nil {
+		return nil, err
+	}
 
 	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
@@ -105,42 +98,169 @@ func newGmailProvider(credsFile string, prefetchN int) (*gmailProvider, error) {
 	return &gmailProvider{
 		prefetchN: prefetchN,
 		service:   srv,
+		auth:      auth,
+		labels:    make(map[string]string),
 	}, nil
 }
 
-func (gmail *gmailProvider) fetch() ([]providerMessage, error) {
+func (gmail *gmailProvider) fetch(ctx context.Context) ([]providerMessage, error) {
+	start := time.Now()
+	defer func() {
+		providerFetchDuration.WithLabelValues("gmail").Observe(time.Since(start).Seconds())
+	}()
+
 	user := "me"
-	r, err := gmail.service.Users.Messages.List(user).Q("is:unread").MaxResults(int64(gmail.prefetchN)).Do()
+	r, err := gmail.service.Users.Messages.List(user).Q("is:unread").MaxResults(int64(gmail.prefetchN)).Context(ctx).Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve messages: %v", err)
+		providerFetchErrors.WithLabelValues("gmail").Inc()
+		return nil, fmt.Errorf("unable to retrieve messages: %v", err)
 	}
 
 	msgs := []providerMessage{}
 	for _, m := range r.Messages {
-		msg, err := gmail.service.Users.Messages.Get(user, m.Id).Format("full").Do()
+		msg, err := gmail.service.Users.Messages.Get(user, m.Id).Format("full").Context(ctx).Do()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			providerFetchErrors.WithLabelValues("gmail").Inc()
 			continue
 		}
+		messagesFetched.WithLabelValues("gmail").Inc()
 		// Parse the internalDate of the message to check if it's within the last 30 minutes
 		internalDate := time.Unix(0, msg.InternalDate*int64(time.Millisecond))
 		if time.Since(internalDate).Minutes() > 30 {
+			messagesSkipped.WithLabelValues("window").Inc()
 			continue
 		}
 		if msg.Payload.Body.Size > 0 {
 			header := make(map[string]string)
 			for _, h := range msg.Payload.Headers {
-				header[h.Name] = h.Value
+				header[textproto.CanonicalMIMEHeaderKey(h.Name)] = h.Value
 			}
-			msgs = append(msgs, providerMessage{header: header, message: msg.Payload.Body.Data})
+			msgs = append(msgs, providerMessage{id: m.Id, threadID: msg.ThreadId, header: header, message: msg.Payload.Body.Data})
 		} else {
 			for _, part := range msg.Payload.Parts {
 				header := make(map[string]string)
 				for _, h := range msg.Payload.Headers {
-					header[h.Name] = h.Value
+					header[textproto.CanonicalMIMEHeaderKey(h.Name)] = h.Value
 				}
-				msgs = append(msgs, providerMessage{header: header, message: part.Body.Data})
+				msgs = append(msgs, providerMessage{id: m.Id, threadID: msg.ThreadId, header: header, message: part.Body.Data})
 			}
 		}
 	}
 	return msgs, nil
 }
+
+// saveDraft stores the reply as a draft in the thread of the original
+// message.
+func (g *gmailProvider) saveDraft(ctx context.Context, d *replyDraft) (string, error) {
+	draft, err := g.service.Users.Drafts.Create("me", &gmail.Draft{
+		Message: &gmail.Message{
+			Raw:      base64.URLEncoding.EncodeToString(d.rfc822()),
+			ThreadId: d.threadID,
+		},
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to save draft: %v", err)
+	}
+	return draft.Id, nil
+}
+
+// modify applies an action by adding or removing the system labels Gmail
+// uses for read, archived and starred messages, or a user label.
+func (g *gmailProvider) modify(ctx context.Context, id, action, label string) (err error) {
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		providerActions.WithLabelValues("gmail", action, result).Inc()
+	}()
+
+	req := &gmail.ModifyMessageRequest{}
+	switch action {
+	case actionRead:
+		req.RemoveLabelIds = []string{"UNREAD"}
+	case actionUnread:
+		req.AddLabelIds = []string{"UNREAD"}
+	case actionArchive:
+		req.RemoveLabelIds = []string{"INBOX"}
+	case actionStar:
+		req.AddLabelIds = []string{"STARRED"}
+	case actionUnstar:
+		req.RemoveLabelIds = []string{"STARRED"}
+	case actionLabel, actionUnlabel:
+		labelID, err := g.labelID(ctx, label, action == actionLabel)
+		if err != nil {
+			return err
+		}
+		if action == actionLabel {
+			req.AddLabelIds = []string{labelID}
+		} else {
+			req.RemoveLabelIds = []string{labelID}
+		}
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if _, err := g.service.Users.Messages.Modify("me", id, req).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to modify message: %v", err)
+	}
+	return nil
+}
+
+// sentTo counts the messages the user sent to the address. Gmail only
+// estimates the count, which is enough to tell whether there are any.
+func (g *gmailProvider) sentTo(ctx context.Context, address string) (int, error) {
+	r, err := g.service.Users.Messages.List("me").Q("in:sent to:" + address).MaxResults(1).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("unable to search sent mail: %v", err)
+	}
+	return int(r.ResultSizeEstimate), nil
+}
+
+// address returns the address of the account.
+func (g *gmailProvider) address(ctx context.Context) (string, error) {
+	p, err := g.service.Users.GetProfile("me").Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve profile: %v", err)
+	}
+	return p.EmailAddress, nil
+}
+
+// labelID returns the ID of the label with the name. Missing labels are
+// created if create is set.
+func (g *gmailProvider) labelID(ctx context.Context, name string, create bool) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("missing label")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if id, ok := g.labels[name]; ok {
+		return id, nil
+	}
+
+	r, err := g.service.Users.Labels.List("me").Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to list labels: %v", err)
+	}
+	for _, l := range r.Labels {
+		g.labels[l.Name] = l.Id
+	}
+	if id, ok := g.labels[name]; ok {
+		return id, nil
+	}
+	if !create {
+		return "", fmt.Errorf("no label %q", name)
+	}
+	l, err := g.service.Users.Labels.Create("me", &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to create label %q: %v", name, err)
+	}
+	g.labels[name] = l.Id
+	return l.Id, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// redactConfig decides which requests are redacted before they reach an LLM.
+type redactConfig struct {
+	// Backends are the backends ("ollama" or "openai") whose requests are
+	// always redacted. It defaults to the cloud backend, openai.
+	Backends []string `json:"backends"`
+	// Accounts are the accounts whose requests are redacted, whatever the
+	// backend.
+	Accounts []string `json:"accounts"`
+	// Patterns are additional regular expressions to redact, by name.
+	Patterns map[string]string `json:"patterns"`
+}
+
+// defaultRedactConfig redacts everything sent to the cloud.
+var defaultRedactConfig = redactConfig{Backends: []string{"openai"}}
+
+// applies reports whether requests of the account to the backend have to be
+// redacted.
+func (c *redactConfig) applies(backend, account string) bool {
+	return contains(c.Backends, backend) || contains(c.Accounts, account)
+}
+
+// redactPattern finds one kind of personal data. valid, if set, weeds out
+// matches that only look like it, like numbers that fail a checksum.
+type redactPattern struct {
+	kind  string
+	re    *regexp.Regexp
+	valid func(s string) bool
+}
+
+// builtinPatterns are applied in order, so the more specific patterns claim
+// their matches before the phone number pattern sees them.
+var builtinPatterns = []redactPattern{
+	{kind: "EMAIL", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{kind: "IBAN", re: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`), valid: validIBAN},
+	{kind: "CARD", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: validLuhn},
+	// US social security and UK national insurance numbers.
+	{kind: "ID", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{kind: "ID", re: regexp.MustCompile(`\b[A-CEGHJ-PR-TW-Z]{2} ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`)},
+	{kind: "PHONE", re: regexp.MustCompile(`(?:\+|\b00|\()\d[\d ()./-]{5,}\d\b|\b\d{3}[ .-]\d{3}[ .-]\d{4}\b`), valid: func(s string) bool {
+		return countDigits(s) >= 7
+	}},
+}
+
+// redactor replaces personal data with placeholders.
+type redactor struct {
+	patterns []redactPattern
+}
+
+// newRedactor returns a redactor for the built-in patterns and the custom
+// patterns of the config.
+func newRedactor(c *redactConfig) (*redactor, error) {
+	r := &redactor{}
+	// Custom patterns go first, they are what the user cares about most.
+	names := []string{}
+	for name := range c.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(c.Patterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %v", name, err)
+		}
+		kind := strings.ToUpper(strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return '_'
+		}, name))
+		r.patterns = append(r.patterns, redactPattern{kind: kind, re: re})
+	}
+	r.patterns = append(r.patterns, builtinPatterns...)
+	return r, nil
+}
+
+// redaction maps the placeholders of a redacted text to the values they
+// replaced.
+type redaction struct {
+	values       map[string]string
+	placeholders map[string]string
+	counts       map[string]int
+}
+
+// redact replaces personal data in text with placeholders like [EMAIL_1].
+// The same value always gets the same placeholder within a redaction, so the
+// LLM can still tell that two mentions are the same.
+func (r *redactor) redact(text string, red *redaction) string {
+	for _, p := range r.patterns {
+		text = p.re.ReplaceAllStringFunc(text, func(s string) string {
+			if p.valid != nil && !p.valid(s) {
+				return s
+			}
+			if ph, ok := red.placeholders[s]; ok {
+				return ph
+			}
+			red.counts[p.kind]++
+			ph := fmt.Sprintf("[%s_%d]", p.kind, red.counts[p.kind])
+			red.placeholders[s] = ph
+			red.values[ph] = s
+			redactions.WithLabelValues(strings.ToLower(p.kind)).Inc()
+			return ph
+		})
+	}
+	return text
+}
+
+func newRedaction() *redaction {
+	return &redaction{
+		values:       make(map[string]string),
+		placeholders: make(map[string]string),
+		counts:       make(map[string]int),
+	}
+}
+
+var placeholderPattern = regexp.MustCompile(`\[[A-Z0-9_]+_\d+\]`)
+
+// restore puts the redacted values back in place of their placeholders.
+func (red *redaction) restore(text string) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(ph string) string {
+		if v, ok := red.values[ph]; ok {
+			return v
+		}
+		return ph
+	})
+}
+
+// restoreStream returns a delta function that restores placeholders before
+// passing text on to delta. Text that could be the start of a placeholder is
+// held back until the placeholder is complete.
+func (red *redaction) restoreStream(delta func(string)) (func(string), func()) {
+	pending := ""
+	write := func(text string) {
+		pending += text
+		cut := len(pending)
+		if i := strings.LastIndexByte(pending, '['); i >= 0 && !strings.Contains(pending[i:], "]") && len(pending)-i < 32 {
+			cut = i
+		}
+		if cut > 0 {
+			delta(red.restore(pending[:cut]))
+			pending = pending[cut:]
+		}
+	}
+	flush := func() {
+		if pending != "" {
+			delta(red.restore(pending))
+			pending = ""
+		}
+	}
+	return write, flush
+}
+
+// redactingLLM redacts personal data from prompts before they reach the
+// backend, and restores it in the results.
+type redactingLLM struct {
+	LLM
+	r *redactor
+}
+
+func newRedactingLLM(ai LLM, r *redactor) *redactingLLM {
+	return &redactingLLM{LLM: ai, r: r}
+}
+
+// name differs from the backend's, since the backend sees different prompts,
+// which can lead to different summaries in the cache.
+func (l *redactingLLM) name() string {
+	return l.LLM.name() + "+redacted"
+}
+
+func (l *redactingLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	// Custom templates can put message fields in the system prompt, so it's
+	// redacted with the same placeholders as the prompt.
+	red := newRedaction()
+	system = l.r.redact(system, red)
+	prompt = l.r.redact(prompt, red)
+
+	var flush func()
+	if delta != nil {
+		delta, flush = red.restoreStream(delta)
+	}
+	out, err := l.LLM.generate(ctx, system, prompt, delta)
+	if flush != nil {
+		flush()
+	}
+	if err != nil {
+		return "", err
+	}
+	return red.restore(out), nil
+}
+
+func countDigits(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// validLuhn reports whether the digits of s pass the Luhn checksum of card
+// numbers.
+func validLuhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// validIBAN reports whether s passes the mod 97 check of IBANs.
+func validIBAN(s string) bool {
+	s = strings.ReplaceAll(s, " ", "")
+	if len(s) < 15 {
+		return false
+	}
+	var digits strings.Builder
+	for _, r := range s[4:] + s[:4] {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			fmt.Fprintf(&digits, "%d", r-'A'+10)
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r, err := newRedactor(&redactConfig{Patterns: map[string]string{"order": `ORD-\d{6}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"email", "Write to jane.doe@example.com today", "Write to [EMAIL_1] today"},
+		{"same value same placeholder", "a@b.io and a@b.io and c@d.io", "[EMAIL_1] and [EMAIL_1] and [EMAIL_2]"},
+		{"iban", "Pay to DE89 3704 0044 0532 0130 00 please", "Pay to [IBAN_1] please"},
+		{"iban with bad checksum", "Ref GB00 WEST 1234 5698 7654 32", "Ref GB00 WEST 1234 5698 7654 32"},
+		{"valid iban", "IBAN GB82 WEST 1234 5698 7654 32", "IBAN [IBAN_1]"},
+		{"card", "Card 4111 1111 1111 1111 expires", "Card [CARD_1] expires"},
+		{"card with bad checksum", "Tracking 4111 1111 1111 1112", "Tracking 4111 1111 1111 1112"},
+		{"ssn", "SSN 123-45-6789", "SSN [ID_1]"},
+		{"nino", "NI number AB 12 34 56 C", "NI number [ID_1]"},
+		{"phone", "Call +1 (555) 123-4567 now", "Call [PHONE_1] now"},
+		{"us phone", "Call 555-123-4567", "Call [PHONE_1]"},
+		{"short numbers stay", "Meeting at 10:30 in room 42, 2024-05-01", "Meeting at 10:30 in room 42, 2024-05-01"},
+		{"custom pattern", "Your order ORD-123456 shipped", "Your order [ORDER_1] shipped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			red := newRedaction()
+			got := r.redact(tt.text, red)
+			if got != tt.want {
+				t.Fatalf("redact(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+			if restored := red.restore(got); restored != tt.text {
+				t.Errorf("restore(%q) = %q, want %q", got, restored, tt.text)
+			}
+		})
+	}
+}
+
+func TestRestoreStream(t *testing.T) {
+	red := newRedaction()
+	red.values["[EMAIL_1]"] = "jane@example.com"
+
+	tests := []struct {
+		name   string
+		deltas []string
+		want   string
+	}{
+		{"whole placeholder", []string{"Mail [EMAIL_1] now"}, "Mail jane@example.com now"},
+		{"split placeholder", []string{"Mail [EM", "AIL", "_1] now"}, "Mail jane@example.com now"},
+		{"unknown placeholder", []string{"See [1", "] and [NOTE_9]"}, "See [1] and [NOTE_9]"},
+		{"unterminated at end", []string{"Mail [EMAIL_"}, "Mail [EMAIL_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			write, flush := red.restoreStream(func(s string) { out.WriteString(s) })
+			for _, d := range tt.deltas {
+				write(d)
+			}
+			flush()
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// echoLLM answers with the prompt it was sent, in two deltas.
+type echoLLM struct {
+	system, prompt string
+}
+
+func (l *echoLLM) name() string { return "echo" }
+
+func (l *echoLLM) contextSize() int { return 4096 }
+
+func (l *echoLLM) tokens(text string) int { return len(text) / 4 }
+
+func (l *echoLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	l.system, l.prompt = system, prompt
+	if delta != nil {
+		delta(prompt[:len(prompt)/2])
+		delta(prompt[len(prompt)/2:])
+	}
+	return prompt, nil
+}
+
+func TestRedactingLLM(t *testing.T) {
+	r, err := newRedactor(&defaultRedactConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := &echoLLM{}
+	ai := newRedactingLLM(echo, r)
+	if ai.name() != "echo+redacted" {
+		t.Errorf("name() = %q", ai.name())
+	}
+
+	const system = "I am bob@example.com, reachable at +44 20 7946 0958"
+	const prompt = "From alice@example.com: call me at +44 20 7946 0958"
+	var streamed strings.Builder
+	out, err := ai.generate(context.Background(), system, prompt, func(s string) { streamed.WriteString(s) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both prompts share the placeholders.
+	if want := "I am [EMAIL_1], reachable at [PHONE_1]"; echo.system != want {
+		t.Errorf("backend got the system prompt %q, want %q", echo.system, want)
+	}
+	if want := "From [EMAIL_2]: call me at [PHONE_1]"; echo.prompt != want {
+		t.Errorf("backend got %q, want %q", echo.prompt, want)
+	}
+	if out != prompt {
+		t.Errorf("generate() = %q, want %q", out, prompt)
+	}
+	if streamed.String() != prompt {
+		t.Errorf("streamed %q, want %q", streamed.String(), prompt)
+	}
+
+	// Neither the corrections, which name other senders, nor message fields
+	// that custom templates put in the system prompt reach the backend.
+	prompts, err := loadPrompts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := parsePrompt("custom", `{{define "system"}}Summarize this mail from {{.Sender}}: {{.Message}}{{end}}{{define "prompt"}}{{.Bio}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrections := []promptCorrection{
+		{Sender: "Carol <carol@example.com>", Subject: "Invoice", Priority: "high", Was: "low"},
+		{Sender: "Dan <dan@example.com>", Subject: "Offsite", ActionItem: "book a room"},
+	}
+	templates := []*promptTemplate{custom}
+	for _, task := range []string{promptSummary, promptActions} {
+		tmpl, err := prompts.get(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates = append(templates, tmpl)
+	}
+	for _, tmpl := range templates {
+		data := promptData{
+			Bio:         system,
+			Sender:      "alice@example.com",
+			Message:     "Write to erin@example.com",
+			Corrections: corrections,
+		}
+		system, prompt, err := tmpl.render(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ai.generate(context.Background(), system, prompt, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range []string{"bob@example.com", "carol@example.com", "dan@example.com", "alice@example.com", "erin@example.com"} {
+			if strings.Contains(echo.system+echo.prompt, addr) {
+				t.Errorf("%s: backend got %s:\n%s\n%s", tmpl.name, addr, echo.system, echo.prompt)
+			}
+		}
+	}
+}
+
+func TestRedactConfigApplies(t *testing.T) {
+	c := redactConfig{Backends: []string{"openai"}, Accounts: []string{"work"}}
+	tests := []struct {
+		backend, account string
+		want             bool
+	}{
+		{"openai", "default", true},
+		{"ollama", "default", false},
+		{"ollama", "work", true},
+	}
+	for _, tt := range tests {
+		if got := c.applies(tt.backend, tt.account); got != tt.want {
+			t.Errorf("applies(%q, %q) = %v, want %v", tt.backend, tt.account, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"time"
+)
+
+// replyDraft is a reply to a stored message.
+type replyDraft struct {
+	to         string
+	subject    string
+	inReplyTo  string
+	references string
+	threadID   string
+	body       string
+	date       time.Time
+}
+
+// newReplyDraft returns a reply to m with the body. The In-Reply-To and
+// References headers make mail clients show it in the thread of m.
+func newReplyDraft(m *sqlMessage, body string) *replyDraft {
+	to := m.ReplyTo
+	if to == "" {
+		to = m.From
+	}
+	subject := m.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	references := strings.TrimSpace(m.References + " " + m.MessageID)
+	return &replyDraft{
+		to:         to,
+		subject:    subject,
+		inReplyTo:  m.MessageID,
+		references: references,
+		threadID:   m.ThreadID,
+		body:       body,
+		date:       time.Now(),
+	}
+}
+
+// rfc822 returns the draft as a plain text message. The sender is left out,
+// so the provider fills in the address of the account.
+func (d *replyDraft) rfc822() []byte {
+	var b bytes.Buffer
+	header := []struct{ key, value string }{
+		{"To", d.to},
+		{"Subject", mime.QEncoding.Encode("utf-8", d.subject)},
+		{"Date", d.date.Format(time.RFC1123Z)},
+		{"In-Reply-To", d.inReplyTo},
+		{"References", d.references},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range header {
+		if h.value != "" {
+			fmt.Fprintf(&b, "%s: %s\r\n", h.key, h.value)
+		}
+	}
+	b.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	qp.Write([]byte(d.body))
+	qp.Close()
+	return b.Bytes()
+}
+
+// draftReply asks the LLM for a reply to the stored message, in the voice of
+// the user and following the instruction.
+func draftReply(ctx context.Context, mbox *mailBox, store *sqliteDB, m *sqlMessage, instruction string) (string, error) {
+	data := store.promptData(m)
+	data.Instruction = instruction
+	reply, err := mbox.generateLong(ctx, mbox.ai, promptReply, data, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(reply), nil
+}
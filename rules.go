@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+)
+
+// rule applies its actions to every message that matches all of its
+// matchers. Rules are evaluated before messages are sent to the LLM.
+type rule struct {
+	Name    string      `json:"name"`
+	Match   ruleMatch   `json:"match"`
+	Actions ruleActions `json:"actions"`
+
+	matchers []ruleMatcher
+}
+
+// ruleMatch holds case-insensitive regular expressions that are matched
+// against a message. Empty fields match every message.
+type ruleMatch struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	ListID  string `json:"list_id"`
+	// Headers maps header names to the expression their value must match.
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+type ruleActions struct {
+	// Skip drops the message completely.
+	Skip bool `json:"skip,omitempty"`
+	// SkipLLM stores the message without summarizing or showing it.
+	SkipLLM bool `json:"skip_llm,omitempty"`
+	// Priority forces the priority of the message: low, med or high.
+	Priority string `json:"priority,omitempty"`
+	// Tags are added to the stored message.
+	Tags []string `json:"tags,omitempty"`
+	// LLM and Prompt choose the backend (from the llms in the config) and
+	// the prompt template used for the summary.
+	LLM    string `json:"llm,omitempty"`
+	Prompt string `json:"prompt,omitempty"`
+	// Silent suppresses desktop notifications.
+	Silent bool `json:"silent,omitempty"`
+	// Bulk overrides the bulk mail detection when it's set: false
+	// summarizes messages that look like newsletters, true collects the
+	// message with the newsletters.
+	Bulk *bool `json:"bulk,omitempty"`
+}
+
+// bulk returns the bulk mail details of a message that detectBulk returned
+// detected for, after the Bulk action.
+func (a ruleActions) bulk(detected *bulkInfo) *bulkInfo {
+	switch {
+	case a.Bulk == nil:
+		return detected
+	case !*a.Bulk:
+		return nil
+	case detected == nil:
+		return &bulkInfo{reason: "rule"}
+	}
+	return detected
+}
+
+type ruleMatcher struct {
+	// header is the canonical name of the matched header, or empty to match
+	// the body.
+	header string
+	re     *regexp.Regexp
+}
+
+func (r *rule) compile() error {
+	r.matchers = nil
+	add := func(header, expr string) error {
+		if expr == "" {
+			return nil
+		}
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+		r.matchers = append(r.matchers, ruleMatcher{header: header, re: re})
+		return nil
+	}
+
+	for _, m := range []struct{ header, expr string }{
+		{"From", r.Match.From},
+		{"To", r.Match.To},
+		{"Subject", r.Match.Subject},
+		{"List-Id", r.Match.ListID},
+	} {
+		if err := add(m.header, m.expr); err != nil {
+			return err
+		}
+	}
+	for name, expr := range r.Match.Headers {
+		if err := add(textproto.CanonicalMIMEHeaderKey(name), expr); err != nil {
+			return err
+		}
+	}
+	if err := add("", r.Match.Body); err != nil {
+		return err
+	}
+
+	switch r.Actions.Priority {
+	case "", "low", "med", "high":
+	default:
+		return fmt.Errorf("rule %q: priority must be low, med or high", r.Name)
+	}
+	return nil
+}
+
+// matches reports whether the message with the header and body matches all
+// matchers of the rule. header is keyed by canonical header names.
+func (r *rule) matches(header map[string]string, body string) bool {
+	for _, m := range r.matchers {
+		value := body
+		if m.header != "" {
+			value = header[m.header]
+		}
+		if !m.re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluateRules combines the actions of all rules that match the message.
+// Later rules override the priority, LLM and prompt of earlier ones, and
+// tags are collected from all of them.
+func evaluateRules(rules []rule, header map[string]string, body string) ruleActions {
+	a := ruleActions{}
+	for i := range rules {
+		if !rules[i].matches(header, body) {
+			continue
+		}
+		r := rules[i].Actions
+		a.Skip = a.Skip || r.Skip
+		a.SkipLLM = a.SkipLLM || r.SkipLLM
+		a.Silent = a.Silent || r.Silent
+		if r.Priority != "" {
+			a.Priority = r.Priority
+		}
+		if r.LLM != "" {
+			a.LLM = r.LLM
+		}
+		if r.Prompt != "" {
+			a.Prompt = r.Prompt
+		}
+		if r.Bulk != nil {
+			a.Bulk = r.Bulk
+		}
+		for _, t := range r.Tags {
+			if !contains(a.Tags, t) {
+				a.Tags = append(a.Tags, t)
+			}
+		}
+	}
+	return a
+}
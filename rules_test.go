@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	header := map[string]string{
+		"From":     "Google Calendar <calendar-notification@google.com>",
+		"To":       "me@example.com",
+		"Subject":  "Invitation: Weekly sync @ Mon",
+		"List-Id":  "<dev.lists.example.com>",
+		"X-Mailer": "Asana",
+	}
+	body := "You have been invited to Weekly sync. Invoice #1234 attached."
+
+	tests := []struct {
+		name  string
+		match ruleMatch
+		want  bool
+	}{
+		{"empty rule matches everything", ruleMatch{}, true},
+		{"from", ruleMatch{From: `calendar-notification@google\.com`}, true},
+		{"from is case-insensitive", ruleMatch{From: `CALENDAR-NOTIFICATION`}, true},
+		{"from mismatch", ruleMatch{From: `asana\.com`}, false},
+		{"to", ruleMatch{To: `^me@example\.com$`}, true},
+		{"subject", ruleMatch{Subject: `^Invitation:`}, true},
+		{"list id", ruleMatch{ListID: `dev\.lists`}, true},
+		{"list id present", ruleMatch{ListID: `.`}, true},
+		{"other header", ruleMatch{Headers: map[string]string{"x-mailer": `^asana$`}}, true},
+		{"absent header", ruleMatch{Headers: map[string]string{"X-Spam": `yes`}}, false},
+		{"body", ruleMatch{Body: `invoice #\d+`}, true},
+		{"all matchers must match", ruleMatch{From: `google`, Subject: `^Re:`}, false},
+		{"all matchers match", ruleMatch{From: `google`, Subject: `Invitation`, Body: `Weekly`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rule{Name: tt.name, Match: tt.match}
+			if err := r.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.matches(header, body); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule rule
+	}{
+		{"invalid from", rule{Match: ruleMatch{From: `(`}}},
+		{"invalid header", rule{Match: ruleMatch{Headers: map[string]string{"X-Foo": `[`}}}},
+		{"invalid body", rule{Match: ruleMatch{Body: `*`}}},
+		{"invalid priority", rule{Actions: ruleActions{Priority: "urgent"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.compile(); err == nil {
+				t.Error("compile() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	no := false
+	rules := []rule{
+		{Name: "skip calendar", Match: ruleMatch{From: `calendar-notification@google\.com`}, Actions: ruleActions{Skip: true}},
+		{Name: "asana", Match: ruleMatch{From: `asana\.com`}, Actions: ruleActions{SkipLLM: true, Tags: []string{"asana"}}},
+		{Name: "boss", Match: ruleMatch{From: `ceo@example\.com`}, Actions: ruleActions{Priority: "high", Tags: []string{"vip"}, LLM: "gpt"}},
+		{Name: "boss reports", Match: ruleMatch{From: `ceo@example\.com`, Subject: `report`}, Actions: ruleActions{Priority: "med", Prompt: "report", Tags: []string{"vip", "report"}}},
+		{Name: "quiet lists", Match: ruleMatch{ListID: `.+`}, Actions: ruleActions{Silent: true}},
+		{Name: "team list", Match: ruleMatch{ListID: `team\.example\.com`}, Actions: ruleActions{Bulk: &no}},
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   ruleActions
+	}{
+		{"no match", map[string]string{"From": "friend@example.com"}, ruleActions{}},
+		{"skip", map[string]string{"From": "calendar-notification@google.com"}, ruleActions{Skip: true}},
+		{"skip llm", map[string]string{"From": "no-reply@asana.com"}, ruleActions{SkipLLM: true, Tags: []string{"asana"}}},
+		{"single rule", map[string]string{"From": "ceo@example.com", "Subject": "Hello"},
+			ruleActions{Priority: "high", Tags: []string{"vip"}, LLM: "gpt"}},
+		{"later rules override", map[string]string{"From": "ceo@example.com", "Subject": "Quarterly report"},
+			ruleActions{Priority: "med", Tags: []string{"vip", "report"}, LLM: "gpt", Prompt: "report"}},
+		{"silent", map[string]string{"From": "ceo@example.com", "List-Id": "<all.example.com>"},
+			ruleActions{Priority: "high", Tags: []string{"vip"}, LLM: "gpt", Silent: true}},
+		{"not bulk", map[string]string{"From": "lead@example.com", "List-Id": "<team.example.com>"},
+			ruleActions{Silent: true, Bulk: &no}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := evaluateRules(rules, tt.header, "")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("evaluateRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleBulk(t *testing.T) {
+	yes, no := true, false
+	detected := &bulkInfo{reason: "List-Id"}
+	tests := []struct {
+		name     string
+		bulk     *bool
+		detected *bulkInfo
+		want     *bulkInfo
+	}{
+		{"detected", nil, detected, detected},
+		{"not detected", nil, nil, nil},
+		{"not bulk", &no, detected, nil},
+		{"bulk", &yes, nil, &bulkInfo{reason: "rule"}},
+		{"bulk and detected", &yes, detected, detected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ruleActions{Bulk: tt.bulk}.bulk(tt.detected)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bulk() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// allowedTags lists the elements that survive sanitization together with the
+// attributes each of them may keep. Everything else is dropped, but its text
+// content is preserved.
+var allowedTags = map[string][]string{
+	"a":          {"href", "title", "target"},
+	"b":          {},
+	"blockquote": {},
+	"br":         {},
+	"code":       {},
+	"del":        {},
+	"em":         {},
+	"h1":         {"id"},
+	"h2":         {"id"},
+	"h3":         {"id"},
+	"h4":         {"id"},
+	"h5":         {"id"},
+	"h6":         {"id"},
+	"hr":         {},
+	"i":          {},
+	"li":         {},
+	"ol":         {"start"},
+	"p":          {},
+	"pre":        {},
+	"span":       {"class"},
+	"strong":     {},
+	"table":      {},
+	"tbody":      {},
+	"td":         {"align"},
+	"th":         {"align"},
+	"thead":      {},
+	"tr":         {},
+	"ul":         {},
+}
+
+// droppedTags are removed together with everything inside them.
+var droppedTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"template": true,
+	"noscript": true,
+	"textarea": true,
+	"title":    true,
+	"svg":      true,
+	"math":     true,
+	"frameset": true,
+	"noembed":  true,
+	"xmp":      true,
+}
+
+var allowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// allowedClasses are the only class names that may appear on a <span>. They
+// are the ones emitted by highlightPriority.
+var allowedClasses = map[string]bool{
+	"priority-low":  true,
+	"priority-med":  true,
+	"priority-high": true,
+}
+
+// sanitizeHTML returns a copy of the HTML fragment that only contains tags and
+// attributes from the allowlist. Links are restricted to http, https and
+// mailto URLs.
+func sanitizeHTML(fragment string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(fragment))
+	skip := ""
+	depth := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return b.String()
+		}
+		tok := z.Token()
+
+		if skip != "" {
+			switch {
+			case tt == html.StartTagToken && tok.Data == skip:
+				depth++
+			case tt == html.EndTagToken && tok.Data == skip:
+				depth--
+				if depth == 0 {
+					skip = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			b.WriteString(html.EscapeString(tok.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[tok.Data] {
+				if tt == html.StartTagToken {
+					skip = tok.Data
+					depth = 1
+				}
+				continue
+			}
+			attrs, ok := allowedTags[tok.Data]
+			if !ok {
+				continue
+			}
+			b.WriteString("<" + tok.Data)
+			for _, a := range tok.Attr {
+				if a.Namespace != "" || !contains(attrs, a.Key) {
+					continue
+				}
+				val, ok := sanitizeAttr(tok.Data, a.Key, a.Val)
+				if !ok {
+					continue
+				}
+				b.WriteString(" " + a.Key + `="` + html.EscapeString(val) + `"`)
+			}
+			if tok.Data == "a" {
+				b.WriteString(` rel="noopener noreferrer"`)
+			}
+			if tt == html.SelfClosingTagToken {
+				b.WriteString("/")
+			}
+			b.WriteString(">")
+		case html.EndTagToken:
+			if _, ok := allowedTags[tok.Data]; ok {
+				b.WriteString("</" + tok.Data + ">")
+			}
+		}
+	}
+}
+
+// sanitizeAttr validates the value of an allowlisted attribute.
+func sanitizeAttr(tag, key, val string) (string, bool) {
+	switch key {
+	case "href":
+		return sanitizeURL(val)
+	case "target":
+		return "_blank", true
+	case "class":
+		classes := []string{}
+		for _, c := range strings.Fields(val) {
+			if allowedClasses[c] {
+				classes = append(classes, c)
+			}
+		}
+		return strings.Join(classes, " "), len(classes) > 0
+	case "align":
+		switch val {
+		case "left", "right", "center":
+			return val, true
+		}
+		return "", false
+	}
+	return val, true
+}
+
+// sanitizeURL accepts absolute URLs with an allowed scheme and relative
+// references without one.
+func sanitizeURL(raw string) (string, bool) {
+	// Browsers ignore control characters and whitespace inside the scheme,
+	// so "java\tscript:" has to be treated like "javascript:".
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, raw)
+	u, err := url.Parse(cleaned)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme == "" {
+		if strings.Contains(cleaned, ":") && !strings.HasPrefix(cleaned, "/") && !strings.HasPrefix(cleaned, "#") && !strings.HasPrefix(cleaned, "?") {
+			return "", false
+		}
+		return cleaned, true
+	}
+	if !allowedSchemes[strings.ToLower(u.Scheme)] {
+		return "", false
+	}
+	return cleaned, true
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestSanitizeHTMLRemovesScript(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"script tag", `<p>hi</p><script>alert(1)</script>`},
+		{"nested script", `<div><script>alert(1)<script>x</script></script></div>`},
+		{"img onerror", `<img src=x onerror=alert(1)>`},
+		{"event handler on allowed tag", `<p onclick="alert(1)">hi</p>`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`},
+		{"mixed case scheme", `<a href="JaVaScRiPt:alert(1)">x</a>`},
+		{"entity encoded scheme", `<a href="jav&#x61;script:alert(1)">x</a>`},
+		{"tab in scheme", "<a href=\"java\tscript:alert(1)\">x</a>"},
+		{"data uri", `<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">x</a>`},
+		{"vbscript", `<a href="vbscript:msgbox(1)">x</a>`},
+		{"svg onload", `<svg onload=alert(1)><script>alert(1)</script></svg>`},
+		{"iframe", `<iframe src="javascript:alert(1)"></iframe>`},
+		{"style attribute", `<span style="background:url(javascript:alert(1))">x</span>`},
+		{"foreign class", `<span class="x" onmouseover="alert(1)">x</span>`},
+		{"unterminated tag", `<p>hi<img src=x onerror=alert(1)//`},
+		{"comment", `<!--<script>alert(1)</script>-->`},
+		{"attribute breakout", `<a href="https://example.com/&quot;onmouseover=&quot;alert(1)">x</a>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertSafeHTML(t, sanitizeHTML(tt.input))
+		})
+	}
+}
+
+func TestSanitizeHTMLMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"javascript link", `[click me](javascript:alert(1))`},
+		{"encoded javascript link", `[click me](javascript&#58;alert(1))`},
+		{"reference link", "[click me][x]\n\n[x]: javascript:alert(1)"},
+		{"autolink", `<javascript:alert(1)>`},
+		{"image", `![x](javascript:alert(1))`},
+		{"raw html block", "<div>\n<script>alert(1)</script>\n</div>"},
+		{"raw inline html", `hello <img src=x onerror="alert(1)"> world`},
+		{"html in list", "- item <iframe src=javascript:alert(1)></iframe>"},
+		{"priority highlight", `- **high** priority <script>alert(1)</script>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertSafeHTML(t, sanitizeHTML(highlightPriority(markdownMessage(tt.input))))
+		})
+	}
+}
+
+func TestSanitizeHTMLKeepsFormatting(t *testing.T) {
+	in := markdownMessage("# Title\n\n- **bold** item\n- [link](https://example.com)\n\n`code`")
+	out := sanitizeHTML(highlightPriority(in))
+	for _, want := range []string{
+		"<h1", "<li>", "<strong>bold</strong>", `href="https://example.com"`, `target="_blank"`, `rel="noopener noreferrer"`, "<code>code</code>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("sanitized output %q is missing %q", out, want)
+		}
+	}
+
+	out = sanitizeHTML(highlightPriority("Priority: high"))
+	if !strings.Contains(out, `<span class="priority-high">high</span>`) {
+		t.Errorf("priority highlight was removed: %q", out)
+	}
+}
+
+// assertSafeHTML re-parses the sanitizer output the way a browser would and
+// fails on any element, attribute or URL that could execute script.
+func assertSafeHTML(t *testing.T, out string) {
+	t.Helper()
+	z := html.NewTokenizer(strings.NewReader(out))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return
+		}
+		tok := z.Token()
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		if _, ok := allowedTags[tok.Data]; !ok {
+			t.Errorf("sanitized output contains <%s>: %s", tok.Data, out)
+		}
+		for _, a := range tok.Attr {
+			key := strings.ToLower(a.Key)
+			if strings.HasPrefix(key, "on") || key == "style" || key == "src" {
+				t.Errorf("sanitized output contains attribute %q: %s", a.Key, out)
+			}
+			if key == "href" {
+				scheme := strings.ToLower(a.Val)
+				for _, bad := range []string{"javascript:", "vbscript:", "data:"} {
+					if strings.HasPrefix(scheme, bad) {
+						t.Errorf("sanitized output contains %s URL: %s", bad, out)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpConfig configures the SMTP server digests and alerts are sent
+// through.
+type smtpConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// TLS is "starttls" (the default), "tls" for implicit TLS, or "none".
+	TLS string `json:"tls"`
+	// Auth is "plain" (the default) or "login". The password can also be
+	// set with $SMTP_PASSWORD.
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// From and To can have display names, like "mailassist <me@example.com>".
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	// Digests sends the scheduled digests and Alerts the summaries of
+	// high priority messages.
+	Digests bool `json:"digests"`
+	Alerts  bool `json:"alerts"`
+}
+
+func (c *smtpConfig) check() error {
+	switch {
+	case c.Host == "":
+		return errors.New("smtp: missing host")
+	case c.From == "":
+		return errors.New("smtp: missing from address")
+	case len(c.To) == 0:
+		return errors.New("smtp: missing to address")
+	}
+	for _, addr := range append([]string{c.From}, c.To...) {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("smtp: invalid address %q: %v", addr, err)
+		}
+	}
+	switch c.TLS {
+	case "", "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("smtp: tls must be starttls, tls or none")
+	}
+	switch c.Auth {
+	case "", "plain", "login":
+	default:
+		return fmt.Errorf("smtp: auth must be plain or login")
+	}
+	return nil
+}
+
+// smtpSender sends multipart text and HTML mail.
+type smtpSender struct {
+	cfg smtpConfig
+	// from and to are the configured addresses, parsed.
+	from *mail.Address
+	to   []*mail.Address
+	// tlsConfig is used for both implicit TLS and STARTTLS.
+	tlsConfig *tls.Config
+}
+
+func newSMTPSender(cfg smtpConfig) (*smtpSender, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+		if cfg.TLS == "tls" {
+			cfg.Port = 465
+		}
+	}
+	if p := os.Getenv("SMTP_PASSWORD"); p != "" {
+		cfg.Password = p
+	}
+	// check made sure the addresses parse.
+	from, _ := mail.ParseAddress(cfg.From)
+	to := make([]*mail.Address, len(cfg.To))
+	for i, addr := range cfg.To {
+		to[i], _ = mail.ParseAddress(addr)
+	}
+	return &smtpSender{
+		cfg:       cfg,
+		from:      from,
+		to:        to,
+		tlsConfig: &tls.Config{ServerName: cfg.Host},
+	}, nil
+}
+
+// send mails the message with a plain text and an HTML part to the
+// configured recipients.
+func (s *smtpSender) send(ctx context.Context, subject, text, html string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	to := make([]string, len(s.to))
+	for i, addr := range s.to {
+		to[i] = addr.String()
+	}
+	msg, err := buildMail(s.from.String(), to, subject, text, html, time.Now())
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	if s.cfg.TLS == "tls" {
+		conn = tls.Client(conn, s.tlsConfig)
+	}
+	// net/smtp doesn't take a context, so the deadline has to do.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp: %v", err)
+	}
+	defer c.Close()
+
+	if s.cfg.TLS == "" || s.cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp: server doesn't support STARTTLS")
+		}
+		if err := c.StartTLS(s.tlsConfig); err != nil {
+			return fmt.Errorf("smtp: %v", err)
+		}
+	}
+	if s.cfg.Username != "" {
+		var auth smtp.Auth
+		if s.cfg.Auth == "login" {
+			auth = &loginAuth{host: s.cfg.Host, username: s.cfg.Username, password: s.cfg.Password}
+		} else {
+			auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+		}
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("smtp: %v", err)
+		}
+	}
+
+	// The envelope only takes the addresses, without display names.
+	if err := c.Mail(s.from.Address); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to.Address); err != nil {
+			return fmt.Errorf("smtp: %v", err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	return c.Quit()
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which some
+// servers offer instead of PLAIN.
+type loginAuth struct {
+	host, username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like smtp.PlainAuth, never send the password in the clear, except to
+	// the local machine.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// buildMail returns a multipart/alternative message with a plain text and an
+// HTML part.
+func buildMail(from string, to []string, subject, text, html string, date time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "mailassist"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = strings.Trim(from[i+1:], ">")
+	}
+
+	header := []struct{ key, value string }{
+		{"From", from},
+		{"To", strings.Join(to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, h := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.key, h.value)
+	}
+	b.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSink is a minimal SMTP server that records the messages it receives.
+type smtpSink struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+	// implicitTLS makes the sink speak TLS from the start.
+	implicitTLS bool
+
+	received chan sinkMessage
+}
+
+type sinkMessage struct {
+	auth string
+	from string
+	to   []string
+	tls  bool
+	data string
+}
+
+func newSMTPSink(t *testing.T, tlsConfig *tls.Config, implicitTLS bool) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{ln: ln, tlsConfig: tlsConfig, implicitTLS: implicitTLS, received: make(chan sinkMessage, 1)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	secure := false
+	if s.implicitTLS {
+		conn = tls.Server(conn, s.tlsConfig)
+		secure = true
+	}
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	readLine := func() string {
+		line, _ := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	msg := sinkMessage{}
+	reply("220 sink ESMTP")
+	for {
+		line := readLine()
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-sink")
+			if s.tlsConfig != nil && !secure {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			reply("220 go ahead")
+			conn = tls.Server(conn, s.tlsConfig)
+			r = bufio.NewReader(conn)
+			secure = true
+		case "AUTH":
+			fields := strings.Fields(line)
+			if fields[1] == "PLAIN" {
+				b, _ := base64.StdEncoding.DecodeString(fields[2])
+				msg.auth = "PLAIN " + strings.ReplaceAll(string(b), "\x00", ":")
+			} else {
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := base64.StdEncoding.DecodeString(readLine())
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				pass, _ := base64.StdEncoding.DecodeString(readLine())
+				msg.auth = "LOGIN " + string(user) + ":" + string(pass)
+			}
+			reply("235 ok")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg.data = data.String()
+			msg.tls = secure
+			s.received <- msg
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		case "":
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// testCert returns a self-signed certificate for 127.0.0.1 and a pool that
+// trusts it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sink"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestSMTPSend(t *testing.T) {
+	cert, pool := testCert(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	tests := []struct {
+		name     string
+		tls      string
+		auth     string
+		wantAuth string
+	}{
+		{"starttls plain", "starttls", "plain", "PLAIN :me:secret"},
+		{"starttls login", "starttls", "login", "LOGIN me:secret"},
+		{"implicit tls", "tls", "plain", "PLAIN :me:secret"},
+		{"no tls on localhost", "none", "login", "LOGIN me:secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sinkTLS *tls.Config
+			if tt.tls != "none" {
+				sinkTLS = serverTLS
+			}
+			sink := newSMTPSink(t, sinkTLS, tt.tls == "tls")
+			s, err := newSMTPSender(smtpConfig{
+				Host:     "127.0.0.1",
+				Port:     sink.port(),
+				TLS:      tt.tls,
+				Auth:     tt.auth,
+				Username: "me",
+				Password: "secret",
+				From:     "mailassist <mailassist@example.com>",
+				To:       []string{"Jörg Me <me@example.com>", "phone@example.com"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.tlsConfig.RootCAs = pool
+
+			err = s.send(context.Background(), "Daily digest, Mon 19 Oct ✓", "# Digest\n\n* high: reply to Ann", "<h1>Digest</h1>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got sinkMessage
+			select {
+			case got = <-sink.received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message received")
+			}
+			if got.tls != (tt.tls != "none") {
+				t.Errorf("tls = %v", got.tls)
+			}
+			if got.auth != tt.wantAuth {
+				t.Errorf("auth = %q, want %q", got.auth, tt.wantAuth)
+			}
+			if got.from != "mailassist@example.com" || strings.Join(got.to, ",") != "me@example.com,phone@example.com" {
+				t.Errorf("envelope = %q → %q", got.from, got.to)
+			}
+			checkDigestMail(t, got.data)
+		})
+	}
+}
+
+// checkDigestMail checks the headers and parts of the message sent in
+// TestSMTPSend.
+func checkDigestMail(t *testing.T, data string) {
+	t.Helper()
+	m, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != "Daily digest, Mon 19 Oct ✓" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+	for _, h := range []string{"Date", "Message-Id"} {
+		if m.Header.Get(h) == "" {
+			t.Errorf("missing %s header", h)
+		}
+	}
+	// The headers keep the display names.
+	from, err := m.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].String() != `"mailassist" <mailassist@example.com>` {
+		t.Errorf("From = %q (%v)", m.Header.Get("From"), err)
+	}
+	to, err := m.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Jörg Me" || to[1].Address != "phone@example.com" {
+		t.Errorf("To = %q (%v)", m.Header.Get("To"), err)
+	}
+	if m.Header.Get("Mime-Version") != "1.0" {
+		t.Errorf("MIME-Version = %q", m.Header.Get("Mime-Version"))
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q (%v)", m.Header.Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	want := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", "# Digest\r\n\r\n* high: reply to Ann"},
+		{"text/html; charset=utf-8", "<h1>Digest</h1>"},
+	}
+	for i, w := range want {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if ct := p.Header.Get("Content-Type"); ct != w.contentType {
+			t.Errorf("part %d: Content-Type = %q, want %q", i, ct, w.contentType)
+		}
+		// NextPart decodes quoted-printable.
+		body, _ := io.ReadAll(p)
+		if string(body) != w.body {
+			t.Errorf("part %d: body = %q, want %q", i, body, w.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected two parts, got %v", err)
+	}
+}
+
+func TestSMTPConfigCheck(t *testing.T) {
+	valid := smtpConfig{Host: "smtp.example.com", From: "a@example.com", To: []string{"b@example.com"}}
+	if err := valid.check(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+	for name, modify := range map[string]func(c *smtpConfig){
+		"no host":  func(c *smtpConfig) { c.Host = "" },
+		"no from":  func(c *smtpConfig) { c.From = "" },
+		"no to":    func(c *smtpConfig) { c.To = nil },
+		"bad from": func(c *smtpConfig) { c.From = "mailassist" },
+		"bad to":   func(c *smtpConfig) { c.To = []string{"b@example.com", "me at example.com"} },
+		"bad tls":  func(c *smtpConfig) { c.TLS = "ssl" },
+		"bad auth": func(c *smtpConfig) { c.Auth = "cram-md5" },
+	} {
+		c := valid
+		modify(&c)
+		if err := c.check(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if s, _ := newSMTPSender(smtpConfig{Host: "h", TLS: "tls", From: "a@example.com", To: []string{"b@example.com"}}); s.cfg.Port != 465 {
+		t.Errorf("implicit tls port = %d", s.cfg.Port)
+	}
+	if s, _ := newSMTPSender(valid); s.cfg.Port != 587 {
+		t.Errorf("starttls port = %d", s.cfg.Port)
+	}
+}
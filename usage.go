@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// llmPrice is the price of a model in US dollars per million tokens.
+type llmPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// openAIPrices are the prices of OpenAI models, by model name prefix. The
+// first matching prefix wins.
+var openAIPrices = []struct {
+	prefix string
+	price  llmPrice
+}{
+	{"gpt-4o-mini", llmPrice{Prompt: 0.15, Completion: 0.6}},
+	{"gpt-4o", llmPrice{Prompt: 5, Completion: 15}},
+	{"gpt-4-turbo", llmPrice{Prompt: 10, Completion: 30}},
+	{"gpt-4-1106", llmPrice{Prompt: 10, Completion: 30}},
+	{"gpt-4-0125", llmPrice{Prompt: 10, Completion: 30}},
+	{"gpt-4-32k", llmPrice{Prompt: 60, Completion: 120}},
+	{"gpt-4", llmPrice{Prompt: 30, Completion: 60}},
+	{"gpt-3.5-turbo-instruct", llmPrice{Prompt: 1.5, Completion: 2}},
+	{"gpt-3.5-turbo", llmPrice{Prompt: 0.5, Completion: 1.5}},
+}
+
+// errBudgetExceeded is returned by backends once the monthly budget is spent,
+// when there is no fallback backend.
+var errBudgetExceeded = errors.New("monthly llm budget exceeded")
+
+// budgetConfig limits the monthly spending on LLM requests.
+type budgetConfig struct {
+	// Monthly is the most to spend per calendar month, in US dollars.
+	Monthly float64 `json:"monthly"`
+	// Fallback is the backend of llms used once the budget is spent, which
+	// should be a local one. Without it, summarizing is paused until the
+	// next month.
+	Fallback string `json:"fallback"`
+}
+
+// sqlUsage records the tokens used by a single LLM request.
+type sqlUsage struct {
+	ID      uint
+	Time    time.Time `gorm:"index"`
+	Account string
+	// Purpose is the prompt template of the request, like "summary".
+	Purpose          string
+	Backend          string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	// Cost is in US dollars, at the prices when the request was made.
+	Cost float64
+}
+
+// llmUsage collects the token counts the backend reports for a request.
+type llmUsage struct {
+	backend, model     string
+	prompt, completion int
+}
+
+type usageKey struct{}
+
+// withUsage returns a context that collects the token counts of the requests
+// made with it.
+func withUsage(ctx context.Context) (context.Context, *llmUsage) {
+	u := &llmUsage{}
+	return context.WithValue(ctx, usageKey{}, u), u
+}
+
+// reportUsage is called by backends with the token counts of a request.
+func reportUsage(ctx context.Context, backend, model string, prompt, completion int) {
+	countTokens(backend, prompt, completion)
+	if u, ok := ctx.Value(usageKey{}).(*llmUsage); ok {
+		u.backend, u.model = backend, model
+		u.prompt += prompt
+		u.completion += completion
+	}
+}
+
+// usageTracker stores the token usage of requests and keeps track of the cost
+// of the current month.
+type usageTracker struct {
+	store *sqliteDB
+	// prices replace the built-in prices, by model.
+	prices map[string]llmPrice
+	budget *budgetConfig
+
+	mu    sync.Mutex
+	month time.Time
+	cost  float64
+}
+
+func newUsageTracker(store *sqliteDB, prices map[string]llmPrice, budget *budgetConfig) *usageTracker {
+	return &usageTracker{
+		store:  store,
+		prices: prices,
+		budget: budget,
+	}
+}
+
+// price returns the price of the model. Local models are free, unless the
+// config sets a price for them.
+func (u *usageTracker) price(backend, model string) llmPrice {
+	if p, ok := u.prices[model]; ok {
+		return p
+	}
+	if backend == "openai" {
+		for _, p := range openAIPrices {
+			if strings.HasPrefix(model, p.prefix) {
+				return p.price
+			}
+		}
+	}
+	return llmPrice{}
+}
+
+// record stores the usage of a request.
+func (u *usageTracker) record(account, purpose string, usage *llmUsage, now time.Time) error {
+	p := u.price(usage.backend, usage.model)
+	cost := (float64(usage.prompt)*p.Prompt + float64(usage.completion)*p.Completion) / 1e6
+	if err := u.store.db.Create(&sqlUsage{
+		Time:             now,
+		Account:          account,
+		Purpose:          purpose,
+		Backend:          usage.backend,
+		Model:            usage.model,
+		PromptTokens:     usage.prompt,
+		CompletionTokens: usage.completion,
+		Cost:             cost,
+	}).Error; err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.month.Equal(monthStart(now)) {
+		u.cost += cost
+	}
+	return nil
+}
+
+// monthCost returns the cost of the month of now so far.
+func (u *usageTracker) monthCost(now time.Time) (float64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	month := monthStart(now)
+	if !u.month.Equal(month) {
+		var cost float64
+		if err := u.store.db.Model(&sqlUsage{}).Select("COALESCE(SUM(cost), 0)").
+			Where("time >= ?", month).Scan(&cost).Error; err != nil {
+			return 0, err
+		}
+		u.month, u.cost = month, cost
+	}
+	return u.cost, nil
+}
+
+// overBudget reports whether the monthly budget is spent.
+func (u *usageTracker) overBudget(now time.Time) bool {
+	if u.budget == nil {
+		return false
+	}
+	cost, err := u.monthCost(now)
+	if err != nil {
+		log.Printf("Could not read llm costs: %v", err)
+		return false
+	}
+	return cost >= u.budget.Monthly
+}
+
+// paused reports whether summarizing is paused because the budget is spent.
+func (u *usageTracker) paused(now time.Time) bool {
+	return u.budget != nil && u.budget.Fallback == "" && u.overBudget(now)
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// usageTotal sums up the requests of a day or month.
+type usageTotal struct {
+	Period           string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+// totals returns the usage since the time, per day or month, depending on
+// layout. The latest period comes first.
+func (u *usageTracker) totals(since time.Time, layout string) ([]usageTotal, error) {
+	var rows []sqlUsage
+	if err := u.store.db.Where("time >= ?", since).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	byPeriod := make(map[string]*usageTotal)
+	for _, r := range rows {
+		period := r.Time.Local().Format(layout)
+		t, ok := byPeriod[period]
+		if !ok {
+			t = &usageTotal{Period: period}
+			byPeriod[period] = t
+		}
+		t.Requests++
+		t.PromptTokens += r.PromptTokens
+		t.CompletionTokens += r.CompletionTokens
+		t.Cost += r.Cost
+	}
+	totals := []usageTotal{}
+	for _, t := range byPeriod {
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Period > totals[j].Period })
+	return totals, nil
+}
+
+// budgetLLM switches to the fallback backend once the monthly budget is
+// spent. Without a fallback, requests fail with errBudgetExceeded instead.
+type budgetLLM struct {
+	LLM
+	usage    *usageTracker
+	fallback LLM
+}
+
+func newBudgetLLM(ai LLM, usage *usageTracker, fallback LLM) *budgetLLM {
+	return &budgetLLM{LLM: ai, usage: usage, fallback: fallback}
+}
+
+// current returns the backend requests go to right now.
+func (l *budgetLLM) current() LLM {
+	if l.fallback != nil && l.usage.overBudget(time.Now()) {
+		return l.fallback
+	}
+	return l.LLM
+}
+
+// name changes with the backend, so summaries of the fallback aren't cached
+// as the summaries of the backend.
+func (l *budgetLLM) name() string {
+	return l.current().name()
+}
+
+func (l *budgetLLM) contextSize() int {
+	return l.current().contextSize()
+}
+
+func (l *budgetLLM) tokens(text string) int {
+	return l.current().tokens(text)
+}
+
+func (l *budgetLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	if l.fallback == nil && l.usage.overBudget(time.Now()) {
+		return "", errBudgetExceeded
+	}
+	return l.current().generate(ctx, system, prompt, delta)
+}
+
+// check validates the budget against the configured backends.
+func (b *budgetConfig) check(llms map[string]llmConfig) error {
+	if b.Monthly <= 0 {
+		return errors.New("budget: monthly must be positive")
+	}
+	if b.Fallback != "" {
+		if _, ok := llms[b.Fallback]; !ok {
+			return fmt.Errorf("budget: unknown fallback llm %q", b.Fallback)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestUsage(t *testing.T, prices map[string]llmPrice, budget *budgetConfig) *usageTracker {
+	t.Helper()
+	store, err := newSqlite(filepath.Join(t.TempDir(), dbFile), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.close() })
+	return newUsageTracker(store, prices, budget)
+}
+
+func TestUsageRecord(t *testing.T) {
+	u := newTestUsage(t, map[string]llmPrice{"mistral": {Prompt: 1, Completion: 2}}, nil)
+	now := time.Date(2024, 7, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		usage llmUsage
+		want  float64
+	}{
+		{llmUsage{backend: "openai", model: "gpt-4o-mini-2024-07-18", prompt: 1000000, completion: 1000000}, 0.75},
+		{llmUsage{backend: "openai", model: "gpt-4-0613", prompt: 1000, completion: 500}, 0.06},
+		{llmUsage{backend: "ollama", model: "zephyr", prompt: 1000, completion: 500}, 0},
+		// Configured prices apply to local models too.
+		{llmUsage{backend: "ollama", model: "mistral", prompt: 500000, completion: 250000}, 1},
+	}
+	var total float64
+	for _, tt := range tests {
+		if err := u.record("default", promptSummary, &tt.usage, now); err != nil {
+			t.Fatal(err)
+		}
+		var row sqlUsage
+		if err := u.store.db.Order("id DESC").First(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(row.Cost-tt.want) > 1e-9 || row.Model != tt.usage.model || row.Purpose != promptSummary {
+			t.Errorf("%s recorded as %+v, want cost %v", tt.usage.model, row, tt.want)
+		}
+		total += tt.want
+	}
+
+	cost, err := u.monthCost(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(cost-total) > 1e-9 {
+		t.Errorf("monthCost() = %v, want %v", cost, total)
+	}
+	// The next month starts from the requests stored in it.
+	cost, err = u.monthCost(now.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != 0 {
+		t.Errorf("monthCost() of the next month = %v, want 0", cost)
+	}
+}
+
+func TestBudgetLLM(t *testing.T) {
+	now := time.Now()
+	spend := func(u *usageTracker, cost float64) {
+		t.Helper()
+		usage := &llmUsage{backend: "ollama", model: "priced", prompt: int(cost * 1e6)}
+		if err := u.record("default", promptSummary, usage, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices := map[string]llmPrice{"priced": {Prompt: 1}}
+
+	t.Run("fallback", func(t *testing.T) {
+		u := newTestUsage(t, prices, &budgetConfig{Monthly: 1, Fallback: "local"})
+		primary, fallback := &echoLLM{}, &scriptedLLM{}
+		ai := newBudgetLLM(primary, u, fallback)
+
+		spend(u, 0.5)
+		if ai.name() != "echo" || u.overBudget(now) {
+			t.Fatalf("switched to %s below the budget", ai.name())
+		}
+		spend(u, 0.5)
+		if ai.name() != "scripted" {
+			t.Errorf("name() = %q once the budget is spent, want the fallback", ai.name())
+		}
+		if _, err := ai.generate(context.Background(), "system", "prompt", nil); err != nil {
+			t.Fatal(err)
+		}
+		if primary.prompt != "" || len(fallback.calls()) != 1 {
+			t.Error("request didn't go to the fallback")
+		}
+		if u.paused(now) {
+			t.Error("paused with a fallback")
+		}
+	})
+
+	t.Run("no fallback", func(t *testing.T) {
+		u := newTestUsage(t, prices, &budgetConfig{Monthly: 1})
+		primary := &echoLLM{}
+		ai := newBudgetLLM(primary, u, nil)
+
+		if _, err := ai.generate(context.Background(), "system", "prompt", nil); err != nil {
+			t.Fatal(err)
+		}
+		spend(u, 1.5)
+		primary.prompt = ""
+		if _, err := ai.generate(context.Background(), "system", "prompt", nil); !errors.Is(err, errBudgetExceeded) {
+			t.Errorf("generate() over the budget = %v, want errBudgetExceeded", err)
+		}
+		if primary.prompt != "" {
+			t.Error("request over the budget reached the backend")
+		}
+		if !u.paused(now) {
+			t.Error("not paused over the budget")
+		}
+	})
+}
+
+// pricedLLM reports the usage of every request as costing a dollar.
+type pricedLLM struct {
+	*scriptedLLM
+}
+
+func (l pricedLLM) generate(ctx context.Context, system, prompt string, delta func(string)) (string, error) {
+	out, err := l.scriptedLLM.generate(ctx, system, prompt, delta)
+	reportUsage(ctx, "ollama", "priced", 1000000, 0)
+	return out, err
+}
+
+func TestRunOncePausesOverBudget(t *testing.T) {
+	h := newHarness(t, "testdata/inbox", inboxReplies)
+	u := newUsageTracker(h.store, map[string]llmPrice{"priced": {Prompt: 1}}, &budgetConfig{Monthly: 1})
+	h.app.mbox.ai = newBudgetLLM(pricedLLM{h.llm}, u, nil)
+	h.app.mbox.usage = u
+	h.app.usage = u
+	// With a single worker, the budget runs out after the first summary.
+	h.app.workers = 1
+	client := h.connect(t)
+
+	if err := h.app.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Only the message that ran into the budget fails, the rest isn't
+	// started.
+	var started, failed int
+	// The newsletters may not be stored either, so a marker ends the cycle.
+	h.web.pushAuthRequired()
+	for _, msg := range client.readUntil(webAuthRequired) {
+		switch msg.Type {
+		case webSummaryStarted:
+			started++
+		case webSummaryFailed:
+			failed++
+		}
+	}
+	if started != 2 || failed != 1 {
+		t.Errorf("started %d summaries and %d failed, want 2 and 1", started, failed)
+	}
+	if n := len(h.llm.calls()); n != 1 {
+		t.Errorf("got %d llm requests, want 1", n)
+	}
+	var msgs []sqlMessage
+	if err := h.store.db.Where("NOT bulk").Find(&msgs).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The rest of the messages are left for a later cycle.
+	if len(msgs) != 1 || msgs[0].Summary == "" {
+		t.Errorf("stored %+v, want the one summarized message", msgs)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"regexp"
 	"strings"
 
 	"github.com/gomarkdown/markdown"
@@ -8,18 +9,33 @@ import (
 	"github.com/gomarkdown/markdown/parser"
 )
 
-func highlightPriority(msg string) string {
-	msg = strings.ReplaceAll(msg, "low", `<span style="font-weight: bold; background: black; color: #99ce88;">low</span>`)
-	msg = strings.ReplaceAll(msg, "medium", `<span style="font-weight: bold; background: black; color: #49a8fc;">medium</span>`)
-	msg = strings.ReplaceAll(msg, "med", `<span style="font-weight: bold; background: black; color: #49a8fc;">med</span>`)
-	msg = strings.ReplaceAll(msg, "high", `<span style="font-weight: bold; background: black; color: #fc6764;">high</span>`)
+// priorityWords are the priority qualifiers the prompts ask for. They only
+// match whole words, so words like "highlight" or "follow" aren't colored.
+var priorityWords = regexp.MustCompile(`(?i)\b(medium|med|low|high)\b`)
+
+// htmlTag matches the tags of rendered HTML, which are left alone when
+// highlighting.
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
 
-	msg = strings.ReplaceAll(msg, "Low", `<span style="font-weight: bold; background: black; color: #99ce88;">Low</span>`)
-	msg = strings.ReplaceAll(msg, "Medium", `<span style="font-weight: bold; background: black; color: #49a8fc;">Medium</span>`)
-	msg = strings.ReplaceAll(msg, "Med", `<span style="font-weight: bold; background: black; color: #49a8fc;">Med</span>`)
-	msg = strings.ReplaceAll(msg, "High", `<span style="font-weight: bold; background: black; color: #fc6764;">High</span>`)
+// highlightPriority colors the priority qualifiers in the text of the
+// rendered summary.
+func highlightPriority(msg string) string {
+	var b strings.Builder
+	last := 0
+	for _, tag := range htmlTag.FindAllStringIndex(msg, -1) {
+		b.WriteString(highlightText(msg[last:tag[0]]))
+		b.WriteString(msg[tag[0]:tag[1]])
+		last = tag[1]
+	}
+	b.WriteString(highlightText(msg[last:]))
+	return b.String()
+}
 
-	return msg
+func highlightText(text string) string {
+	return priorityWords.ReplaceAllStringFunc(text, func(word string) string {
+		class := "priority-" + normalizePriority(word)
+		return `<span class="` + class + `">` + word + `</span>`
+	})
 }
 
 func markdownMessage(msg string) string {
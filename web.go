@@ -1,87 +1,295 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"html"
 	"log"
 	"net/http"
+	"net/mail"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Types of messages sent over the websocket.
+const (
+	// webSummaryStarted announces a message that is being summarized.
+	webSummaryStarted = "summary_started"
+	// webSummaryDelta carries the next chunk of a summary as plain text.
+	webSummaryDelta = "summary_delta"
+	// webSummaryCompleted carries the finished, rendered summary.
+	webSummaryCompleted = "summary_completed"
+	// webSummaryFailed carries the error of a summary, which is tried again
+	// in the next cycle.
+	webSummaryFailed = "summary_failed"
+	// webNewsletters announces newly stored bulk mail.
+	webNewsletters = "newsletters"
+	// webAuthRequired tells the user to authorize mailassist again.
+	webAuthRequired = "auth_required"
 )
 
 type webMsg struct {
-	Date     string
-	From     string
-	Subject  string
-	Message  string
-	Original string
+	Type     string
+	ID       string
+	Date     string   `json:",omitempty"`
+	From     string   `json:",omitempty"`
+	Subject  string   `json:",omitempty"`
+	Message  string   `json:",omitempty"`
+	Original string   `json:",omitempty"`
+	Delta    string   `json:",omitempty"`
+	Priority string   `json:",omitempty"`
+	Tags     []string `json:",omitempty"`
+	// Score is the priority score and Reasons the signals it's made of.
+	Score   int      `json:",omitempty"`
+	Reasons []string `json:",omitempty"`
+	// Time is the date of the message in Unix seconds, for sorting.
+	Time int64 `json:",omitempty"`
 }
 
 type webAPI struct {
+	mu        sync.Mutex
 	listeners []chan webMsg
+	assetsDir string
+
+	srv     *http.Server
+	done    chan struct{}
+	clients sync.WaitGroup
 }
 
-func newWebAPI() *webAPI {
+// newWebAPI starts the web UI. The UI is served from the assets embedded in
+// the binary, unless assetsDir points to a directory to serve instead.
+func newWebAPI(assetsDir string) *webAPI {
 	web := &webAPI{
 		listeners: []chan webMsg{},
+		assetsDir: assetsDir,
+		srv:       &http.Server{Addr: ":8080"},
+		done:      make(chan struct{}),
 	}
 
 	go func() {
-		if err := web.serve(); err != nil {
+		if err := web.serve(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Could not run web: %v\n", err)
 		}
 	}()
 	return web
 }
 
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
 func (web *webAPI) serve() error {
-	var upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+	assets, err := newAssetHandler(web.assetsDir)
+	if err != nil {
+		return err
 	}
+	http.Handle("/", assets)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/ws", web.serveWebsocket)
+	return web.srv.ListenAndServe()
+}
 
-	fs := http.FileServer(http.Dir("./html"))
-	http.Handle("/", fs)
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		websocket, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		log.Println("Websocket Connected!")
-		web.listen(websocket)
+// serveWebsocket upgrades the request to a websocket, which receives the
+// pushed messages until it's closed.
+func (web *webAPI) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	websocket, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("Websocket Connected!")
+	web.listen(websocket)
+}
+
+// shutdown stops accepting connections and closes all websocket clients.
+func (web *webAPI) shutdown(ctx context.Context) error {
+	close(web.done)
+	err := web.srv.Shutdown(ctx)
+
+	// Shutdown doesn't wait for hijacked connections.
+	closed := make(chan struct{})
+	go func() {
+		web.clients.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
+
+// pushStarted tells clients that a summary for the message is on its way.
+func (web *webAPI) pushStarted(m *mailMessage) error {
+	return web.send(webMsg{
+		Type:    webSummaryStarted,
+		ID:      m.id(),
+		Date:    html.EscapeString(m.date),
+		From:    html.EscapeString(m.from),
+		Subject: html.EscapeString(m.conversation.subject),
+	})
+}
+
+// pushDelta sends the next chunk of a summary. The UI shows deltas as plain
+// text until the completed summary arrives.
+func (web *webAPI) pushDelta(id, text string) error {
+	return web.send(webMsg{
+		Type:  webSummaryDelta,
+		ID:    id,
+		Delta: text,
+	})
+}
+
+// pushFailed tells the UI that the summary of the message failed. The error
+// is shown as plain text.
+func (web *webAPI) pushFailed(id string, err error) error {
+	return web.send(webMsg{
+		Type:  webSummaryFailed,
+		ID:    id,
+		Delta: err.Error(),
+	})
+}
+
+// push sends the rendered summary and original of a message to all connected
+// clients. The UI inserts the fields as HTML, so headers are escaped and the
+// bodies are sanitized here.
+func (web *webAPI) push(m *mailMessage, message string, original string) error {
+	var t int64
+	if d, err := mail.ParseDate(m.date); err == nil {
+		t = d.Unix()
+	}
+	return web.send(webMsg{
+		Type:     webSummaryCompleted,
+		ID:       m.id(),
+		Date:     html.EscapeString(m.date),
+		From:     html.EscapeString(m.from),
+		Subject:  html.EscapeString(m.conversation.subject),
+		Message:  sanitizeHTML(message),
+		Original: sanitizeHTML(original),
+		Priority: html.EscapeString(m.priority.Level),
+		Tags:     escapeAll(m.actions.Tags),
+		Score:    m.priority.Score,
+		Reasons:  escapeAll(m.priority.Reasons),
+		Time:     t,
 	})
-	return http.ListenAndServe(":8080", nil)
 }
 
-func (web *webAPI) push(from, date, subject, message string, original string) error {
-	log.Printf("Listeners: %d\n", len(web.listeners))
+// storedMsg returns a stored summary like push sends it.
+func storedMsg(m *sqlMessage) webMsg {
+	id := m.MessageID
+	if id == "" {
+		id = m.ProviderID
+	}
+	return webMsg{
+		Type:     webSummaryCompleted,
+		ID:       id,
+		Date:     html.EscapeString(m.Date.Format(time.RFC1123Z)),
+		From:     html.EscapeString(m.From),
+		Subject:  html.EscapeString(m.Subject),
+		Message:  sanitizeHTML(highlightPriority(markdownMessage(m.Summary))),
+		Original: sanitizeHTML(markdownMessage(m.Original)),
+		Priority: html.EscapeString(m.Priority),
+		Tags:     escapeAll(m.Tags),
+		Score:    m.Score,
+		Reasons:  escapeAll(m.ScoreReasons),
+		Time:     m.Date.Unix(),
+	}
+}
+
+func escapeAll(values []string) []string {
+	escaped := []string{}
+	for _, v := range values {
+		escaped = append(escaped, html.EscapeString(v))
+	}
+	return escaped
+}
+
+// pushNewsletters tells clients to reload the newsletter digest.
+func (web *webAPI) pushNewsletters() error {
+	return web.send(webMsg{Type: webNewsletters})
+}
+
+// pushAuthRequired tells clients that the authorization with the provider
+// was revoked.
+func (web *webAPI) pushAuthRequired() error {
+	return web.send(webMsg{Type: webAuthRequired})
+}
+
+func (web *webAPI) send(msg webMsg) error {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	if msg.Type != webSummaryDelta {
+		log.Printf("Listeners: %d\n", len(web.listeners))
+	}
 	for i := range web.listeners {
-		msg := webMsg{
-			Date:     date,
-			From:     from,
-			Subject:  subject,
-			Message:  message,
-			Original: original,
-		}
 		select {
 		case web.listeners[i] <- msg:
 		default:
+			webPushesDropped.WithLabelValues(msg.Type).Inc()
 		}
 	}
 	return nil
 }
 
 func (web *webAPI) listen(conn *websocket.Conn) {
-	outCh := make(chan webMsg, 1)
+	web.clients.Add(1)
+	defer web.clients.Done()
+	defer conn.Close()
+	outCh := make(chan webMsg, 64)
+	web.mu.Lock()
 	web.listeners = append(web.listeners, outCh)
-	for msg := range outCh {
-		b, err := json.Marshal(msg)
-		if err != nil {
-			log.Printf("Error marshaling message: %v\n", err)
-			continue
+	web.mu.Unlock()
+	webClients.Inc()
+	defer webClients.Dec()
+	defer web.remove(outCh)
+
+	// The client never sends anything, but reading is the only way to
+	// notice that it went away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
 		}
-		if err := conn.WriteMessage(1, b); err != nil {
-			log.Printf("Client disconnected: %v\n", err)
+	}()
+
+	for {
+		select {
+		case <-web.done:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(time.Second))
+			return
+		case <-closed:
+			log.Println("Client disconnected")
+			return
+		case msg := <-outCh:
+			b, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Error marshaling message: %v\n", err)
+				continue
+			}
+			if err := conn.WriteMessage(1, b); err != nil {
+				log.Printf("Client disconnected: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+func (web *webAPI) remove(ch chan webMsg) {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	for i := range web.listeners {
+		if web.listeners[i] == ch {
+			web.listeners = append(web.listeners[:i], web.listeners[i+1:]...)
 			return
 		}
 	}